@@ -9,7 +9,8 @@ require (
 	github.com/btnguyen2k/singu v0.1.1
 	github.com/go-akka/configuration v0.0.0-20200115015912-550403a6bd87
 	github.com/golang/protobuf v1.3.2
+	github.com/klauspost/compress v1.12.3
 	github.com/labstack/echo/v4 v4.1.14
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+	github.com/prometheus/client_golang v1.5.1
 	google.golang.org/grpc v1.26.0
 )
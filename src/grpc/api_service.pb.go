@@ -27,11 +27,13 @@ const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 // Log message structure
 type PLogMessage struct {
-	Category             string   `protobuf:"bytes,1,opt,name=category,proto3" json:"category,omitempty"`
-	Message              string   `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Category             string            `protobuf:"bytes,1,opt,name=category,proto3" json:"category,omitempty"`
+	Message              string            `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Timestamp            int64             `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Fields               map[string]string `protobuf:"bytes,4,rep,name=fields,proto3" json:"fields,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *PLogMessage) Reset()         { *m = PLogMessage{} }
@@ -73,6 +75,20 @@ func (m *PLogMessage) GetMessage() string {
 	return ""
 }
 
+func (m *PLogMessage) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *PLogMessage) GetFields() map[string]string {
+	if m != nil {
+		return m.Fields
+	}
+	return nil
+}
+
 type PLogResult struct {
 	Status               int32    `protobuf:"varint,1,opt,name=status,proto3" json:"status,omitempty"`
 	NumSuccess           int32    `protobuf:"varint,2,opt,name=numSuccess,proto3" json:"numSuccess,omitempty"`
@@ -130,29 +146,35 @@ func (m *PLogResult) GetMessage() string {
 
 func init() {
 	proto.RegisterType((*PLogMessage)(nil), "PLogMessage")
+	proto.RegisterMapType((map[string]string)(nil), "PLogMessage.FieldsEntry")
 	proto.RegisterType((*PLogResult)(nil), "PLogResult")
 }
 
 func init() { proto.RegisterFile("api_service.proto", fileDescriptor_dac1f622be3e5824) }
 
 var fileDescriptor_dac1f622be3e5824 = []byte{
-	// 250 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x8f, 0xcd, 0x4a, 0xc3, 0x40,
-	0x10, 0x80, 0x89, 0xfd, 0xb1, 0x9d, 0x7a, 0x71, 0x91, 0x12, 0x22, 0x48, 0xe9, 0x29, 0xa7, 0x2d,
-	0x28, 0xf8, 0x00, 0x16, 0xc1, 0x83, 0x82, 0x24, 0x37, 0x0f, 0xca, 0x76, 0x19, 0x87, 0xc0, 0xa6,
-	0xb3, 0xec, 0x8f, 0xd0, 0x57, 0xf1, 0x69, 0x25, 0x1b, 0x2b, 0xf1, 0xa0, 0xc7, 0x6f, 0x66, 0xf8,
-	0x86, 0x0f, 0xce, 0x95, 0x6d, 0xde, 0x3c, 0xba, 0x8f, 0x46, 0xa3, 0xb4, 0x8e, 0x03, 0x17, 0x97,
-	0xc4, 0x4c, 0x06, 0x37, 0x89, 0x76, 0xf1, 0x7d, 0x83, 0xad, 0x0d, 0x87, 0x7e, 0xb9, 0xde, 0xc2,
-	0xe2, 0xf9, 0x91, 0xe9, 0x09, 0xbd, 0x57, 0x84, 0xa2, 0x80, 0x99, 0x56, 0x01, 0x89, 0xdd, 0x21,
-	0xcf, 0x56, 0x59, 0x39, 0xaf, 0x7e, 0x58, 0xe4, 0x70, 0xda, 0xf6, 0x67, 0xf9, 0x49, 0x5a, 0x1d,
-	0x71, 0xfd, 0x0a, 0xd0, 0x49, 0x2a, 0xf4, 0xd1, 0x04, 0xb1, 0x84, 0xa9, 0x0f, 0x2a, 0x44, 0x9f,
-	0x0c, 0x93, 0xea, 0x9b, 0xc4, 0x15, 0xc0, 0x3e, 0xb6, 0x75, 0xd4, 0x1a, 0xbd, 0x4f, 0x8a, 0x49,
-	0x35, 0x98, 0x0c, 0xfd, 0xa3, 0x5f, 0xfe, 0xeb, 0xcf, 0x0c, 0x2e, 0xba, 0x07, 0x5b, 0x36, 0x06,
-	0x75, 0x60, 0x57, 0xf7, 0x81, 0xe2, 0x16, 0xc6, 0xb6, 0xd9, 0x93, 0x58, 0xca, 0xbe, 0x51, 0x1e,
-	0x1b, 0xe5, 0x7d, 0xd7, 0x58, 0xfc, 0x31, 0x17, 0x2b, 0x18, 0x19, 0x26, 0x71, 0x26, 0x07, 0xed,
-	0xc5, 0x42, 0x0e, 0x22, 0x4a, 0x98, 0x1b, 0xa6, 0x3a, 0x38, 0x54, 0xed, 0x3f, 0x77, 0x65, 0x76,
-	0x37, 0x7b, 0xc8, 0x5e, 0xc6, 0xe4, 0xac, 0xde, 0x4d, 0xd3, 0x97, 0x9b, 0xaf, 0x00, 0x00, 0x00,
-	0xff, 0xff, 0xae, 0xde, 0x6f, 0xf9, 0x84, 0x01, 0x00, 0x00,
+	// 324 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x50, 0x41, 0x4b, 0xf3, 0x40,
+	0x14, 0x64, 0x9b, 0xb6, 0x5f, 0xfb, 0xf2, 0x1d, 0x74, 0x29, 0x25, 0x44, 0x91, 0xd0, 0x53, 0x4e,
+	0x5b, 0xa9, 0x20, 0xea, 0x51, 0xa9, 0x78, 0x50, 0x90, 0xf4, 0xe6, 0x41, 0xd9, 0xc6, 0xd7, 0x25,
+	0xb8, 0xe9, 0x86, 0xdd, 0x4d, 0x21, 0x7f, 0xc5, 0x1f, 0xe5, 0x6f, 0x92, 0x24, 0x8d, 0xae, 0x07,
+	0xbd, 0xed, 0xcc, 0x9b, 0x7d, 0xf3, 0x66, 0xe0, 0x90, 0x17, 0xd9, 0x8b, 0x41, 0xbd, 0xcb, 0x52,
+	0x64, 0x85, 0x56, 0x56, 0x85, 0x47, 0x42, 0x29, 0x21, 0x71, 0xde, 0xa0, 0x75, 0xb9, 0x99, 0x63,
+	0x5e, 0xd8, 0xaa, 0x1d, 0xce, 0x3e, 0x08, 0xf8, 0x8f, 0xf7, 0x4a, 0x3c, 0xa0, 0x31, 0x5c, 0x20,
+	0x0d, 0x61, 0x94, 0x72, 0x8b, 0x42, 0xe9, 0x2a, 0x20, 0x11, 0x89, 0xc7, 0xc9, 0x17, 0xa6, 0x01,
+	0xfc, 0xcb, 0x5b, 0x59, 0xd0, 0x6b, 0x46, 0x1d, 0xa4, 0xc7, 0x30, 0xb6, 0x59, 0x8e, 0xc6, 0xf2,
+	0xbc, 0x08, 0xbc, 0x88, 0xc4, 0x5e, 0xf2, 0x4d, 0xd0, 0x53, 0x18, 0x6e, 0x32, 0x94, 0xaf, 0x26,
+	0xe8, 0x47, 0x5e, 0xec, 0x2f, 0x02, 0xe6, 0x38, 0xb2, 0xdb, 0x66, 0xb4, 0xdc, 0x5a, 0x5d, 0x25,
+	0x7b, 0x5d, 0x78, 0x09, 0xbe, 0x43, 0xd3, 0x03, 0xf0, 0xde, 0xb0, 0xbb, 0xa7, 0x7e, 0xd2, 0x09,
+	0x0c, 0x76, 0x5c, 0x96, 0xdd, 0x21, 0x2d, 0xb8, 0xea, 0x5d, 0x90, 0xd9, 0x33, 0x40, 0xbd, 0x3d,
+	0x41, 0x53, 0x4a, 0x4b, 0xa7, 0x30, 0x34, 0x96, 0xdb, 0xd2, 0x34, 0x9f, 0x07, 0xc9, 0x1e, 0xd1,
+	0x13, 0x80, 0x6d, 0x99, 0xaf, 0xca, 0x34, 0x45, 0x63, 0x9a, 0x25, 0x83, 0xc4, 0x61, 0xdc, 0xa8,
+	0xde, 0x8f, 0xa8, 0x8b, 0x77, 0x02, 0x93, 0xda, 0xe0, 0x46, 0x49, 0x89, 0xa9, 0x55, 0x7a, 0xd5,
+	0x96, 0x4d, 0xcf, 0xa1, 0x5f, 0x64, 0x5b, 0x41, 0xa7, 0xac, 0xed, 0x9b, 0x75, 0x7d, 0xb3, 0x65,
+	0xdd, 0x77, 0xf8, 0x0b, 0x4f, 0x23, 0xf0, 0xa4, 0x12, 0xf4, 0xbf, 0x5b, 0x4a, 0xe8, 0x33, 0x27,
+	0x44, 0x0c, 0x63, 0xa9, 0xc4, 0xca, 0x6a, 0xe4, 0xf9, 0x1f, 0xba, 0x98, 0x5c, 0x8f, 0xee, 0xc8,
+	0x53, 0x5f, 0xe8, 0x22, 0x5d, 0x0f, 0x1b, 0x97, 0xb3, 0xcf, 0x01, 0x00, 0xde, 0x21, 0x4d, 0x0f,
+	0x10, 0x02, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -171,7 +193,7 @@ type PLogCollectorServiceClient interface {
 	Ping(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*empty.Empty, error)
 	// Send a log message to collector service.
 	Log(ctx context.Context, in *PLogMessage, opts ...grpc.CallOption) (*PLogResult, error)
-	// Send a log message to collector service.
+	// Send stream of log messages to collector service.
 	LogStream(ctx context.Context, opts ...grpc.CallOption) (PLogCollectorService_LogStreamClient, error)
 }
 
@@ -241,7 +263,7 @@ type PLogCollectorServiceServer interface {
 	Ping(context.Context, *empty.Empty) (*empty.Empty, error)
 	// Send a log message to collector service.
 	Log(context.Context, *PLogMessage) (*PLogResult, error)
-	// Send a log message to collector service.
+	// Send stream of log messages to collector service.
 	LogStream(PLogCollectorService_LogStreamServer) error
 }
 
@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"main/src/utils"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConfRetryBackoff      = "retry_backoff"
+	DefaultRetryBaseDelay = 1 * time.Second
+	DefaultRetryMaxDelay  = 1 * time.Minute
+	DefaultRetryJitter    = 0.2
+)
+
+// RetryBackoff is the backoff policy of retrying failed writes of a category:
+// delay before the n-th retry is min(BaseDelay * 2^(n-1), MaxDelay), randomized by +/- Jitter (a fraction of the delay)
+type RetryBackoff struct {
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Jitter    float64
+}
+
+// ParseRetryBackoff parses backoff policy from block "retry_backoff" {base_delay, max_delay, jitter} of log writer configurations
+func ParseRetryBackoff(conf map[string]interface{}) (RetryBackoff, error) {
+	backoff := RetryBackoff{BaseDelay: DefaultRetryBaseDelay, MaxDelay: DefaultRetryMaxDelay, Jitter: DefaultRetryJitter}
+	v, ok := conf[ConfRetryBackoff]
+	if !ok || v == nil {
+		return backoff, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return backoff, errors.New(fmt.Sprintf("invalid [%s], expecting an object but received %T", ConfRetryBackoff, v))
+	}
+	for k, v := range m {
+		var err error
+		switch k {
+		case "base_delay":
+			backoff.BaseDelay, err = utils.ParseDuration(fmt.Sprintf("%v", v))
+		case "max_delay":
+			backoff.MaxDelay, err = utils.ParseDuration(fmt.Sprintf("%v", v))
+		case "jitter":
+			backoff.Jitter, err = strconv.ParseFloat(strings.TrimSpace(fmt.Sprintf("%v", v)), 64)
+			if err == nil && (backoff.Jitter < 0 || backoff.Jitter > 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return backoff, errors.New(fmt.Sprintf("invalid [%s.%s]: %s", ConfRetryBackoff, k, err))
+		}
+	}
+	if backoff.BaseDelay < 0 || backoff.MaxDelay < backoff.BaseDelay {
+		return backoff, errors.New(fmt.Sprintf("invalid [%s]: base_delay must not be negative and max_delay must not be less than base_delay", ConfRetryBackoff))
+	}
+	return backoff, nil
+}
+
+// Delay returns the delay before the next attempt, after a log entry has failed to be written for the attempts-th time
+func (b RetryBackoff) Delay(attempts int) time.Duration {
+	d := float64(b.BaseDelay) * math.Pow(2, float64(attempts-1))
+	if d > float64(b.MaxDelay) {
+		d = float64(b.MaxDelay)
+	}
+	d *= 1 + b.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
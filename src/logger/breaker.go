@@ -0,0 +1,158 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"main/src/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ConfCircuitBreaker             = "circuit_breaker"
+	DefaultBreakerFailureThreshold = 5
+	DefaultBreakerOpenDuration     = 30 * time.Second
+
+	BreakerClosed   = "closed"    // writes are allowed
+	BreakerOpen     = "open"      // writes are not allowed
+	BreakerHalfOpen = "half-open" // one probe write is allowed to check if the log writer has recovered
+)
+
+// CircuitBreaker stops writing to a failing log writer for a while:
+//	- the breaker opens after FailureThreshold consecutive failed writes
+//	- after OpenDuration, the breaker becomes half-open and allows one probe write
+//	- the breaker closes if the probe write succeeds, or opens again if it fails
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+
+	lock        sync.Mutex
+	state       string
+	failures    int       // number of consecutive failed writes
+	openedAt    time.Time // time the breaker opened
+	probeSentAt time.Time // time the probe write was allowed (zero if no probe in progress)
+}
+
+// ParseCircuitBreaker parses circuit breaker from block "circuit_breaker" {failure_threshold, open_duration} of log writer
+// configurations. Returns nil if circuit breaker is disabled (failure_threshold=0).
+func ParseCircuitBreaker(conf map[string]interface{}) (*CircuitBreaker, error) {
+	breaker := &CircuitBreaker{FailureThreshold: DefaultBreakerFailureThreshold, OpenDuration: DefaultBreakerOpenDuration, state: BreakerClosed}
+	if v, ok := conf[ConfCircuitBreaker]; ok && v != nil {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid [%s], expecting an object but received %T", ConfCircuitBreaker, v))
+		}
+		for k, v := range m {
+			var err error
+			switch k {
+			case "failure_threshold":
+				breaker.FailureThreshold, err = strconv.Atoi(strings.TrimSpace(fmt.Sprintf("%v", v)))
+				if err == nil && breaker.FailureThreshold < 0 {
+					err = errors.New("must not be negative")
+				}
+			case "open_duration":
+				breaker.OpenDuration, err = utils.ParseDuration(fmt.Sprintf("%v", v))
+				if err == nil && breaker.OpenDuration <= 0 {
+					err = errors.New("must be positive")
+				}
+			default:
+				err = errors.New("unknown key")
+			}
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid [%s.%s]: %s", ConfCircuitBreaker, k, err))
+			}
+		}
+	}
+	if breaker.FailureThreshold == 0 {
+		return nil, nil
+	}
+	return breaker, nil
+}
+
+// State returns current state of the breaker: closed, open or half-open
+func (b *CircuitBreaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen && !time.Now().Before(b.openedAt.Add(b.OpenDuration)) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Allow checks if a write is allowed. If not, the time the next write (probe) is allowed is returned.
+func (b *CircuitBreaker) Allow() (bool, time.Time) {
+	if b == nil {
+		return true, time.Time{}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	switch b.state {
+	case BreakerOpen:
+		if probeAt := b.openedAt.Add(b.OpenDuration); now.Before(probeAt) {
+			return false, probeAt
+		}
+		b.state, b.probeSentAt = BreakerHalfOpen, now
+		return true, time.Time{}
+	case BreakerHalfOpen:
+		// only one probe at a time, another probe is allowed if the result of the current one is not reported in time
+		if probeAt := b.probeSentAt.Add(b.OpenDuration); now.Before(probeAt) {
+			return false, probeAt
+		}
+		b.probeSentAt = now
+		return true, time.Time{}
+	}
+	return true, time.Time{}
+}
+
+// RejectUntil returns the time until which writes are rejected (an open breaker, or a probe write in progress), or zero
+// time if a write is allowed now. Unlike Allow, the state of the breaker is not changed.
+func (b *CircuitBreaker) RejectUntil() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var until time.Time
+	switch b.state {
+	case BreakerOpen:
+		until = b.openedAt.Add(b.OpenDuration)
+	case BreakerHalfOpen:
+		until = b.probeSentAt.Add(b.OpenDuration)
+	}
+	if !time.Now().Before(until) {
+		return time.Time{}
+	}
+	return until
+}
+
+// Record records result of a write, returns true if state of the breaker changes
+func (b *CircuitBreaker) Record(err error) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case err == nil:
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.state = BreakerClosed
+			return true
+		}
+	case b.state == BreakerHalfOpen:
+		b.state, b.openedAt = BreakerOpen, time.Now()
+		return true
+	case b.state == BreakerClosed:
+		if b.failures++; b.failures >= b.FailureThreshold {
+			b.state, b.openedAt = BreakerOpen, time.Now()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ConfConcurrency          = "concurrency"
+	DefaultConcurrencyWeight = 1
+)
+
+// Concurrency controls how write slots (max_write_threads) are shared with other categories:
+//	- MaxThreads: max number of concurrent writes of the category (0 = a fair share: max(1, max_write_threads / number of categories))
+//	- Weight: number of write slots the category receives in each weighted round-robin round when categories compete for slots
+type Concurrency struct {
+	MaxThreads int
+	Weight     int
+}
+
+// ParseConcurrency parses write concurrency from block "concurrency" {max_threads, weight} of log writer configurations
+func ParseConcurrency(conf map[string]interface{}) (Concurrency, error) {
+	concurrency := Concurrency{MaxThreads: 0, Weight: DefaultConcurrencyWeight}
+	v, ok := conf[ConfConcurrency]
+	if !ok || v == nil {
+		return concurrency, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return concurrency, errors.New(fmt.Sprintf("invalid [%s], expecting an object but received %T", ConfConcurrency, v))
+	}
+	for k, v := range m {
+		var err error
+		switch k {
+		case "max_threads":
+			concurrency.MaxThreads, err = strconv.Atoi(strings.TrimSpace(fmt.Sprintf("%v", v)))
+			if err == nil && concurrency.MaxThreads < 0 {
+				err = errors.New("must not be negative")
+			}
+		case "weight":
+			concurrency.Weight, err = strconv.Atoi(strings.TrimSpace(fmt.Sprintf("%v", v)))
+			if err == nil && concurrency.Weight <= 0 {
+				err = errors.New("must be positive")
+			}
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return concurrency, errors.New(fmt.Sprintf("invalid [%s.%s]: %s", ConfConcurrency, k, err))
+		}
+	}
+	return concurrency, nil
+}
@@ -0,0 +1,150 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btnguyen2k/consu/reddo"
+	"github.com/btnguyen2k/consu/semita"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NewConsoleLogWriter creates a new log writer that writes logs to console (stdout or stderr), initialized and ready for use.
+//	- cat: log category name
+//	- conf: log writer configurations
+func NewConsoleLogWriter(cat string, confMap map[string]interface{}) (ILogWriter, error) {
+	logWriter := &ConsoleLogWriter{category: cat}
+	return logWriter, logWriter.Init(confMap)
+}
+
+// ConsoleLogWriter writes logs to console (stdout or stderr)
+// @available since v0.1.4
+type ConsoleLogWriter struct {
+	category     string // log category
+	target       string // target to write logs to (stdout or stderr)
+	retrySeconds int    // number of seconds to retry writing log entry in case of failure
+
+	output  io.Writer
+	logType string
+	lock    sync.Mutex
+	inited  bool
+}
+
+const (
+	confConsoleTarget  = "target"
+	confConsoleLogType = "log_type"
+
+	consoleTargetStdout  = "stdout"
+	consoleTargetStderr  = "stderr"
+	defaultConsoleTarget = consoleTargetStdout
+)
+
+// consoleLocks serializes writes to each console stream, shared by log writers of all categories writing to the same stream
+var consoleLocks = map[string]*sync.Mutex{
+	consoleTargetStdout: {},
+	consoleTargetStderr: {},
+}
+
+// Info implements ILogWriter.Info
+func (w *ConsoleLogWriter) Info() map[string]interface{} {
+	return map[string]interface{}{
+		"name":          "console",
+		"desc":          "This log writer writes log messages to console (" + w.target + ")",
+		"retry_seconds": w.retrySeconds,
+	}
+}
+
+// Init implements ILogWriter.Init
+func (w *ConsoleLogWriter) Init(confMap map[string]interface{}) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.inited {
+		log.Printf("Intializing ConsoleLogWriter for category [%s]...", w.category)
+		if err := w.applyConfig(semita.NewSemita(confMap)); err != nil {
+			return err
+		}
+		w.inited = true
+	}
+	return nil
+}
+
+// applyConfig parses and applies log writer's configurations
+func (w *ConsoleLogWriter) applyConfig(conf *semita.Semita) error {
+	// config: target
+	target, _ := conf.GetValueOfType(confConsoleTarget, reddo.TypeString)
+	if target == nil {
+		target = ""
+	}
+	w.target = strings.ToLower(strings.TrimSpace(target.(string)))
+	if w.target == "" {
+		w.target = defaultConsoleTarget
+	}
+	switch w.target {
+	case consoleTargetStdout:
+		w.output = os.Stdout
+	case consoleTargetStderr:
+		w.output = os.Stderr
+	default:
+		return errors.New(fmt.Sprintf("invalid [%s] configuration: %s", confConsoleTarget, w.target))
+	}
+
+	// config: log type
+	logType, _ := conf.GetValueOfType(confConsoleLogType, reddo.TypeString)
+	if logType == nil {
+		logType = ""
+	}
+	w.logType = strings.TrimSpace(logType.(string))
+	if w.logType != logTypeTsv && w.logType != logTypeJson {
+		w.logType = defaultLogType
+	}
+
+	// config: retry seconds
+	if retrySeconds, err := conf.GetValueOfType(ConfRetrySeconds, reddo.TypeInt); err != nil || retrySeconds == nil {
+		w.retrySeconds = DefaultRetrySeconds
+	} else {
+		w.retrySeconds = int(retrySeconds.(int64))
+	}
+	return nil
+}
+
+// Destroy implements ILogWriter.Write
+func (w *ConsoleLogWriter) Destroy() error {
+	return nil
+}
+
+// RefreshConfig implements ILogWriter.RefreshConfig
+func (w *ConsoleLogWriter) RefreshConfig(confMap map[string]interface{}) error {
+	// validate new configurations before applying
+	newW := &ConsoleLogWriter{category: w.category}
+	if err := newW.applyConfig(semita.NewSemita(confMap)); err != nil {
+		return err
+	}
+	log.Printf("Refreshing ConsoleLogWriter for category [%s]...", w.category)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.target, w.output, w.logType, w.retrySeconds = newW.target, newW.output, newW.logType, newW.retrySeconds
+	return nil
+}
+
+// Write implements ILogWriter.Write
+func (w *ConsoleLogWriter) Write(entry *LogEntry) error {
+	if !w.inited {
+		return errors.New("this log writer has not been initialized")
+	}
+
+	w.lock.Lock()
+	target, output, logType := w.target, w.output, w.logType
+	w.lock.Unlock()
+	data := formatLogMessage(logType, entry)
+	if data == nil {
+		return errors.New("cannot format log message for writing")
+	}
+	lock := consoleLocks[target]
+	lock.Lock()
+	defer lock.Unlock()
+	_, err := output.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,52 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"main/src/utils"
+	"strings"
+	"time"
+)
+
+const (
+	ConfDelivery       = "delivery"
+	ConfSyncTimeout    = "sync_timeout"
+	DeliveryAsync      = "async" // gateways respond as soon as log entries are put to buffer
+	DeliverySync       = "sync"  // gateways respond after log entries are written by the log writer
+	DefaultSyncTimeout = 10 * time.Second
+)
+
+// Delivery controls when gateways acknowledge log entries of a category:
+//	- Mode: "async" (default) or "sync"
+//	- SyncTimeout: max time to wait for the log writer to write a log entry in "sync" mode
+type Delivery struct {
+	Mode        string
+	SyncTimeout time.Duration
+}
+
+// IsSync returns true if log entries of the category are written before gateways respond
+func (d Delivery) IsSync() bool {
+	return d.Mode == DeliverySync
+}
+
+// ParseDelivery parses delivery mode from "delivery" and "sync_timeout" of log writer configurations
+func ParseDelivery(conf map[string]interface{}) (Delivery, error) {
+	delivery := Delivery{Mode: DeliveryAsync, SyncTimeout: DefaultSyncTimeout}
+	if v, ok := conf[ConfDelivery]; ok && v != nil {
+		delivery.Mode = strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", v)))
+		if delivery.Mode != DeliveryAsync && delivery.Mode != DeliverySync {
+			return delivery, errors.New(fmt.Sprintf("invalid [%s]: expecting [%s] or [%s] but received [%s]", ConfDelivery, DeliveryAsync, DeliverySync, delivery.Mode))
+		}
+	}
+	if v, ok := conf[ConfSyncTimeout]; ok && v != nil {
+		var err error
+		delivery.SyncTimeout, err = utils.ParseDuration(fmt.Sprintf("%v", v))
+		if err == nil && delivery.SyncTimeout <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			return delivery, errors.New(fmt.Sprintf("invalid [%s]: %s", ConfSyncTimeout, err))
+		}
+	}
+	return delivery, nil
+}
@@ -0,0 +1,187 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LogEntry represents a log entry collected by prista.
+type LogEntry struct {
+	Category  string            `json:"category"`          // category name
+	Message   string            `json:"message"`           // message to log
+	Timestamp time.Time         `json:"timestamp"`         // time the log message was created, as supplied by the client (defaults to Received)
+	Received  time.Time         `json:"received"`          // time the entry was received by this prista instance
+	Source    string            `json:"source,omitempty"`  // address of the client that sent the entry, if known
+	Gateway   string            `json:"gateway,omitempty"` // gateway the entry was received from (http, grpc, udp...)
+	Fields    map[string]string `json:"fields,omitempty"`  // optional extra fields
+
+	Attempts    int       `json:"-"` // number of failed attempts to write the entry
+	NextAttempt time.Time `json:"-"` // the entry is not written again before this time (backoff after failed attempts)
+}
+
+// NewLogEntry creates a new LogEntry instance, received at the current time.
+func NewLogEntry(category, message string) *LogEntry {
+	now := time.Now()
+	return &LogEntry{Category: category, Message: message, Timestamp: now, Received: now}
+}
+
+// Clone returns a copy of the log entry.
+func (e *LogEntry) Clone() *LogEntry {
+	clone := *e
+	if e.Fields != nil {
+		clone.Fields = make(map[string]string, len(e.Fields))
+		for k, v := range e.Fields {
+			clone.Fields[k] = v
+		}
+	}
+	return &clone
+}
+
+/*
+Binary format of a serialized log entry:
+  - 2 magic bytes 0xFF 'P' (0xFF never appears in UTF-8 text, which distinguishes the binary format from the legacy "<category>\t<message>" payload)
+  - 1 byte format version
+  - list of fields, each is encoded as: 1 byte tag, uvarint length, value
+
+Fields with unknown tags are skipped when decoding, so new fields can be added without bumping format version.
+*/
+const (
+	entryFormatVersion = 1
+
+	entryTagCategory  = 1
+	entryTagMessage   = 2
+	entryTagReceived  = 3 // int64 unix nano, big endian
+	entryTagSource    = 4
+	entryTagGateway   = 5
+	entryTagField     = 6 // uvarint key length, key, value
+	entryTagTimestamp = 7 // int64 unix nano, big endian
+	entryTagAttempts  = 8 // uvarint
+	entryTagNextTry   = 9 // int64 unix nano, big endian
+)
+
+var entryMagic = []byte{0xFF, 'P'}
+
+func appendEntryField(buf *bytes.Buffer, tag byte, value []byte) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	buf.WriteByte(tag)
+	buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(value)))])
+	buf.Write(value)
+}
+
+func appendEntryTime(buf *bytes.Buffer, tag byte, t time.Time) {
+	if !t.IsZero() {
+		var v [8]byte
+		binary.BigEndian.PutUint64(v[:], uint64(t.UnixNano()))
+		appendEntryField(buf, tag, v[:])
+	}
+}
+
+// Marshal serializes the log entry to bytes.
+func (e *LogEntry) Marshal() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(e.Category)+len(e.Message)+64))
+	buf.Write(entryMagic)
+	buf.WriteByte(entryFormatVersion)
+	appendEntryField(buf, entryTagCategory, []byte(e.Category))
+	appendEntryField(buf, entryTagMessage, []byte(e.Message))
+	appendEntryTime(buf, entryTagReceived, e.Received)
+	appendEntryTime(buf, entryTagTimestamp, e.Timestamp)
+	if e.Source != "" {
+		appendEntryField(buf, entryTagSource, []byte(e.Source))
+	}
+	if e.Gateway != "" {
+		appendEntryField(buf, entryTagGateway, []byte(e.Gateway))
+	}
+	for k, v := range e.Fields {
+		var lenBuf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(lenBuf[:], uint64(len(k)))
+		appendEntryField(buf, entryTagField, append(append(lenBuf[:n], k...), v...))
+	}
+	if e.Attempts > 0 {
+		var v [binary.MaxVarintLen64]byte
+		appendEntryField(buf, entryTagAttempts, v[:binary.PutUvarint(v[:], uint64(e.Attempts))])
+	}
+	appendEntryTime(buf, entryTagNextTry, e.NextAttempt)
+	return buf.Bytes()
+}
+
+// UnmarshalLogEntry deserializes a log entry from bytes.
+//
+// Payload in legacy format "<category-name><tab-character><log-message>" (queued by prista before log entry model was introduced) is also accepted.
+// Message of legacy payload can contain tab characters, and the Timestamp and Received timestamps are left zero.
+func UnmarshalLogEntry(data []byte) (*LogEntry, error) {
+	if !bytes.HasPrefix(data, entryMagic) {
+		return unmarshalLegacyLogEntry(data)
+	}
+	data = data[len(entryMagic):]
+	if len(data) < 1 {
+		return nil, errors.New("invalid log entry: missing format version")
+	}
+	if data[0] != entryFormatVersion {
+		return nil, errors.New(fmt.Sprintf("invalid log entry: unsupported format version %d", data[0]))
+	}
+	data = data[1:]
+	entry := &LogEntry{}
+	for len(data) > 0 {
+		tag := data[0]
+		l, n := binary.Uvarint(data[1:])
+		if n <= 0 || uint64(len(data)-1-n) < l {
+			return nil, errors.New(fmt.Sprintf("invalid log entry: truncated field %d", tag))
+		}
+		value := data[1+n : 1+n+int(l)]
+		data = data[1+n+int(l):]
+		switch tag {
+		case entryTagCategory:
+			entry.Category = string(value)
+		case entryTagMessage:
+			entry.Message = string(value)
+		case entryTagReceived, entryTagTimestamp, entryTagNextTry:
+			if len(value) != 8 {
+				return nil, errors.New("invalid log entry: invalid timestamp")
+			}
+			t := time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+			switch tag {
+			case entryTagReceived:
+				entry.Received = t
+			case entryTagTimestamp:
+				entry.Timestamp = t
+			default:
+				entry.NextAttempt = t
+			}
+		case entryTagAttempts:
+			attempts, n := binary.Uvarint(value)
+			if n <= 0 {
+				return nil, errors.New("invalid log entry: invalid attempts")
+			}
+			entry.Attempts = int(attempts)
+		case entryTagSource:
+			entry.Source = string(value)
+		case entryTagGateway:
+			entry.Gateway = string(value)
+		case entryTagField:
+			kl, kn := binary.Uvarint(value)
+			if kn <= 0 || uint64(len(value)-kn) < kl {
+				return nil, errors.New("invalid log entry: invalid field")
+			}
+			if entry.Fields == nil {
+				entry.Fields = make(map[string]string)
+			}
+			entry.Fields[string(value[kn:kn+int(kl)])] = string(value[kn+int(kl):])
+		}
+	}
+	if entry.Category == "" {
+		return nil, errors.New("invalid log entry: missing category")
+	}
+	return entry, nil
+}
+
+func unmarshalLegacyLogEntry(data []byte) (*LogEntry, error) {
+	tokens := strings.SplitN(string(data), SeparatorTsv, 2)
+	if len(tokens) != 2 || tokens[0] == "" {
+		return nil, errors.New("invalid log entry: expected format <category-name><tab-character><log-message>")
+	}
+	return &LogEntry{Category: tokens[0], Message: tokens[1]}, nil
+}
@@ -0,0 +1,79 @@
+package logger
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogEntryMarshalUnmarshal(t *testing.T) {
+	received := time.Unix(1600000000, 123456789)
+	testCases := []struct {
+		name  string
+		entry *LogEntry
+	}{
+		{"minimal", &LogEntry{Category: "default"}},
+		{"message", &LogEntry{Category: "default", Message: "a log message"}},
+		{"timestamps", &LogEntry{Category: "default", Message: "msg", Timestamp: received.Add(-time.Hour), Received: received}},
+		{"source and gateway", &LogEntry{Category: "web", Message: "msg", Received: received, Source: "10.0.0.1", Gateway: "http"}},
+		{"fields", &LogEntry{Category: "web", Message: "msg", Fields: map[string]string{"host": "web-1", "": "empty key", "level": ""}}},
+		{"tabs and new lines", &LogEntry{Category: "web", Message: "line 1\nline 2\tcolumn 2"}},
+		{"unicode", &LogEntry{Category: "người dùng", Message: "xin chào 👋"}},
+		{"retry state", &LogEntry{Category: "web", Message: "msg", Attempts: 300, NextAttempt: received.Add(time.Minute)}},
+	}
+	for _, tc := range testCases {
+		data := tc.entry.Marshal()
+		entry, err := UnmarshalLogEntry(data)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+			continue
+		}
+		if !entry.Timestamp.Equal(tc.entry.Timestamp) || !entry.Received.Equal(tc.entry.Received) || !entry.NextAttempt.Equal(tc.entry.NextAttempt) {
+			t.Errorf("%s: timestamps mismatched, expected %v but received %v", tc.name, tc.entry, entry)
+		}
+		// timestamps are compared above, location and monotonic clock are not preserved
+		expected := tc.entry.Clone()
+		expected.Timestamp, expected.Received, expected.NextAttempt = entry.Timestamp, entry.Received, entry.NextAttempt
+		if !reflect.DeepEqual(expected, entry) {
+			t.Errorf("%s: expected %#v but received %#v", tc.name, expected, entry)
+		}
+	}
+}
+
+func TestUnmarshalLogEntry(t *testing.T) {
+	valid := (&LogEntry{Category: "default", Message: "msg"}).Marshal()
+	testCases := []struct {
+		name     string
+		data     []byte
+		expected *LogEntry
+	}{
+		{"legacy", []byte("default\ta log message"), &LogEntry{Category: "default", Message: "a log message"}},
+		{"legacy with tabs", []byte("default\tcolumn 1\tcolumn 2"), &LogEntry{Category: "default", Message: "column 1\tcolumn 2"}},
+		{"legacy empty message", []byte("default\t"), &LogEntry{Category: "default", Message: ""}},
+		{"unknown tag is skipped", append(append([]byte{}, valid...), 99, 3, 'a', 'b', 'c'), &LogEntry{Category: "default", Message: "msg"}},
+		{"legacy without tab", []byte("default"), nil},
+		{"legacy without category", []byte("\tmsg"), nil},
+		{"empty", []byte{}, nil},
+		{"missing version", []byte{0xFF, 'P'}, nil},
+		{"unsupported version", []byte{0xFF, 'P', 2, entryTagCategory, 1, 'c'}, nil},
+		{"missing category", []byte{0xFF, 'P', entryFormatVersion, entryTagMessage, 1, 'm'}, nil},
+		{"truncated field", []byte{0xFF, 'P', entryFormatVersion, entryTagCategory, 10, 'c'}, nil},
+		{"truncated length", []byte{0xFF, 'P', entryFormatVersion, entryTagCategory}, nil},
+		{"invalid timestamp", []byte{0xFF, 'P', entryFormatVersion, entryTagCategory, 1, 'c', entryTagReceived, 2, 0, 0}, nil},
+		{"invalid field", []byte{0xFF, 'P', entryFormatVersion, entryTagCategory, 1, 'c', entryTagField, 2, 5, 'k'}, nil},
+	}
+	for _, tc := range testCases {
+		entry, err := UnmarshalLogEntry(tc.data)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected error but received %#v", tc.name, entry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+		} else if !reflect.DeepEqual(tc.expected, entry) {
+			t.Errorf("%s: expected %#v but received %#v", tc.name, tc.expected, entry)
+		}
+	}
+}
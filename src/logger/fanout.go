@@ -2,7 +2,6 @@ package logger
 
 import (
 	"errors"
-	"fmt"
 	"github.com/btnguyen2k/consu/reddo"
 	"github.com/btnguyen2k/consu/semita"
 	"log"
@@ -44,45 +43,61 @@ func (w *FanoutLogWriter) Info() map[string]interface{} {
 
 // Init implements ILogWriter.Init
 func (w *FanoutLogWriter) Init(confMap map[string]interface{}) error {
-	fmt.Printf("%#v\n", confMap)
-
 	w.lock.Lock()
 	defer w.lock.Unlock()
 	if !w.inited {
 		log.Printf("Intializing FanoutLogWriter for category [%s]...", w.category)
-		conf := semita.NewSemita(confMap)
-
 		if w.enqueueFunc == nil {
 			return errors.New("enqueue function is not assigned")
 		}
-
-		// config: targets
-		if targets, err := conf.GetValueOfType(confFanoutTargets, reddo.TypeString); err != nil {
+		if targets, err := parseFanoutTargets(semita.NewSemita(confMap)); err != nil {
 			return err
 		} else {
-			w.targets = regexp.MustCompile("[,;\\s]+").Split(targets.(string), -1)
-		}
-		if len(w.targets) == 0 {
-			return errors.New("empty target category list")
+			w.targets = targets
 		}
-
 		w.inited = true
 	}
 	return nil
 }
 
+func parseFanoutTargets(conf *semita.Semita) ([]string, error) {
+	// config: targets
+	targets, err := conf.GetValueOfType(confFanoutTargets, reddo.TypeString)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0)
+	for _, target := range regexp.MustCompile("[,;\\s]+").Split(targets.(string), -1) {
+		if target != "" {
+			result = append(result, target)
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.New("empty target category list")
+	}
+	return result, nil
+}
+
 // Destroy implements ILogWriter.Write
 func (w *FanoutLogWriter) Destroy() error {
 	return nil
 }
 
 // RefreshConfig implements ILogWriter.RefreshConfig
-func (w *FanoutLogWriter) RefreshConfig(conf map[string]interface{}) error {
-	panic("implement me")
+func (w *FanoutLogWriter) RefreshConfig(confMap map[string]interface{}) error {
+	targets, err := parseFanoutTargets(semita.NewSemita(confMap))
+	if err != nil {
+		return err
+	}
+	log.Printf("Refreshing FanoutLogWriter for category [%s]...", w.category)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.targets = targets
+	return nil
 }
 
 // Write implements ILogWriter.Write
-func (w *FanoutLogWriter) Write(category, message string) error {
+func (w *FanoutLogWriter) Write(entry *LogEntry) error {
 	if !w.inited {
 		return errors.New("this log writer has not been initialized")
 	}
@@ -90,7 +105,9 @@ func (w *FanoutLogWriter) Write(category, message string) error {
 	defer w.lock.Unlock()
 
 	for _, target := range w.targets {
-		if err := w.enqueueFunc([]byte(target+SeparatorTsv+message), false); err != nil {
+		targetEntry := entry.Clone()
+		targetEntry.Category = target
+		if err := w.enqueueFunc(targetEntry, false); err != nil {
 			return err
 		}
 	}
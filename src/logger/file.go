@@ -1,13 +1,14 @@
 package logger
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/btnguyen2k/consu/reddo"
 	"github.com/btnguyen2k/consu/semita"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -28,21 +29,39 @@ type FileLogWriter struct {
 	filePattern  string // log file pattern (accept Go style of datetime format)
 	retrySeconds int    // number of seconds to retry writing log entry in case of failure
 
+	maxFileSize int64 // max size of a log file before it is rolled within the same time bucket (0: no limit)
+
 	currentFileName string
 	currentFile     *os.File
+	currentFileSize int64
+	rollIndex       int
+	retention       fileRetention
+	fileRegexp      *regexp.Regexp  // regular expression matching names of files generated by this writer
+	compress        string          // compression of closed log files: gzip, zstd or none
+	compressQueue   chan string     // closed log files waiting to be compressed
+	compressing     map[string]bool // files waiting for or being compressed
+	stop            chan struct{}   // closed to stop background go routines
+	wg              sync.WaitGroup
 	logType         string
 	lock            sync.Mutex
 	inited          bool
 }
 
 const (
-	confFileRoot    = "root"
-	confFilePattern = "file_pattern"
-	confFileLogType = "log_type"
+	confFileRoot        = "root"
+	confFilePattern     = "file_pattern"
+	confFileLogType     = "log_type"
+	confFileMaxFileSize = "max_file_size"
+
+	confFileMaxAge          = "max_age"
+	confFileMaxFiles        = "max_files"
+	confFileMaxTotalSize    = "max_total_size"
+	confFileArchiveDir      = "archive_dir"
+	confFileCleanupInterval = "cleanup_interval"
+
+	defaultCleanupInterval = 1 * time.Minute
 
-	logTypeTsv     = "tsv"
-	logTypeJson    = "json"
-	defaultLogType = logTypeJson
+	confFileCompress = "compress"
 )
 
 // Info implements ILogWriter.Info
@@ -60,53 +79,142 @@ func (w *FileLogWriter) Init(confMap map[string]interface{}) error {
 	defer w.lock.Unlock()
 	if !w.inited {
 		log.Printf("Intializing FileLogWriter for category [%s]...", w.category)
-		conf := semita.NewSemita(confMap)
-
-		// config: root
-		if root, err := conf.GetValueOfType(confFileRoot, reddo.TypeString); err != nil {
+		if err := w.applyConfig(semita.NewSemita(confMap)); err != nil {
 			return err
-		} else {
-			w.root = strings.TrimPrefix(strings.TrimSpace(root.(string)), "/")
-		}
-		if w.root == "" {
-			log.Println("WARN: no root directory defined, default to current directory")
 		}
-
-		// config: file pattern
-		if filePattern, err := conf.GetValueOfType(confFilePattern, reddo.TypeString); err != nil {
+		if err := w.start(); err != nil {
 			return err
-		} else {
-			w.filePattern = strings.TrimSpace(filePattern.(string))
-		}
-		if w.filePattern == "" {
-			return errors.New(fmt.Sprintf("no [%s] configuration defined", confFilePattern))
 		}
+		w.inited = true
+	}
+	return nil
+}
 
-		// config: log type
-		logType, _ := conf.GetValueOfType(confFileLogType, reddo.TypeString)
-		if logType == nil {
-			logType = ""
-		}
-		w.logType = strings.TrimSpace(logType.(string))
-		if w.logType != logTypeTsv && w.logType != logTypeJson {
-			w.logType = defaultLogType
-		}
+// applyConfig parses and applies log writer's configurations
+func (w *FileLogWriter) applyConfig(conf *semita.Semita) error {
+	// config: root
+	if root, err := conf.GetValueOfType(confFileRoot, reddo.TypeString); err != nil {
+		return err
+	} else {
+		w.root = strings.TrimPrefix(strings.TrimSpace(root.(string)), "/")
+	}
+	if w.root == "" {
+		log.Println("WARN: no root directory defined, default to current directory")
+	}
 
-		if retrySeconds, err := conf.GetValueOfType(ConfRetrySeconds, reddo.TypeInt); err != nil {
-			w.retrySeconds = DefaultRetrySeconds
-		} else {
-			w.retrySeconds = int(retrySeconds.(int64))
+	// config: file pattern
+	if filePattern, err := conf.GetValueOfType(confFilePattern, reddo.TypeString); err != nil {
+		return err
+	} else {
+		w.filePattern = strings.TrimSpace(filePattern.(string))
+	}
+	if w.filePattern == "" {
+		return errors.New(fmt.Sprintf("no [%s] configuration defined", confFilePattern))
+	}
+
+	// config: log type
+	logType, _ := conf.GetValueOfType(confFileLogType, reddo.TypeString)
+	if logType == nil {
+		logType = ""
+	}
+	w.logType = strings.TrimSpace(logType.(string))
+	if w.logType != logTypeTsv && w.logType != logTypeJson {
+		w.logType = defaultLogType
+	}
+
+	// config: max file size
+	if maxFileSize, err := getConfByteSize(conf, confFileMaxFileSize, 0); err != nil {
+		return err
+	} else {
+		w.maxFileSize = maxFileSize
+	}
+
+	// config: retention
+	if err := w.initRetention(conf); err != nil {
+		return err
+	}
+
+	if retrySeconds, err := conf.GetValueOfType(ConfRetrySeconds, reddo.TypeInt); err != nil || retrySeconds == nil {
+		w.retrySeconds = DefaultRetrySeconds
+	} else {
+		w.retrySeconds = int(retrySeconds.(int64))
+	}
+
+	// config: compress
+	compress, _ := conf.GetValueOfType(confFileCompress, reddo.TypeString)
+	if compress == nil || strings.TrimSpace(compress.(string)) == "" {
+		compress = compressNone
+	}
+	w.compress = strings.ToLower(strings.TrimSpace(compress.(string)))
+	if _, ok := compressExtensions[w.compress]; !ok && w.compress != compressNone {
+		return errors.New(fmt.Sprintf("invalid [%s] configuration: %s", confFileCompress, w.compress))
+	}
+	return nil
+}
+
+// start creates directories and starts background go routines. Caller must hold w.lock.
+func (w *FileLogWriter) start() error {
+	if err := os.MkdirAll(w.root, 0755); err != nil {
+		return err
+	}
+	if w.retention.archiveDir != "" {
+		if err := os.MkdirAll(w.retention.archiveDir, 0755); err != nil {
+			return err
 		}
+	}
 
-		if err := os.MkdirAll(w.root, 0755); err != nil {
+	w.stop = make(chan struct{})
+	if w.compress != compressNone {
+		w.compressQueue = make(chan string, compressQueueSize)
+		w.compressing = make(map[string]bool)
+		if err := w.recoverCompress(); err != nil {
 			return err
 		}
+		w.wg.Add(1)
+		go w.goCompress(w.stop)
+	}
+	if w.retention.enabled() {
+		w.wg.Add(1)
+		go w.goCleanup(w.stop)
+	}
+	return nil
+}
 
-		w.inited = true
+func (w *FileLogWriter) initRetention(conf *semita.Semita) error {
+	var err error
+	w.retention = fileRetention{}
+	if w.fileRegexp, err = filePatternToRegexp(w.filePattern); err != nil {
+		return err
+	}
+	if w.retention.maxAge, err = getConfDuration(conf, confFileMaxAge, 0); err != nil {
+		return err
+	}
+	if maxFiles, err := conf.GetValueOfType(confFileMaxFiles, reddo.TypeInt); err == nil && maxFiles != nil {
+		w.retention.maxFiles = int(maxFiles.(int64))
+	}
+	if w.retention.maxTotalSize, err = getConfByteSize(conf, confFileMaxTotalSize, 0); err != nil {
+		return err
+	}
+	if archiveDir, err := conf.GetValueOfType(confFileArchiveDir, reddo.TypeString); err == nil && archiveDir != nil {
+		w.retention.archiveDir = strings.TrimSpace(archiveDir.(string))
+	}
+	if w.retention.interval, err = getConfDuration(conf, confFileCleanupInterval, defaultCleanupInterval); err != nil {
+		return err
+	}
+	if w.retention.interval <= 0 {
+		w.retention.interval = defaultCleanupInterval
+	}
+	if w.retention.enabled() && strings.ContainsAny(w.filePattern, `/\`) {
+		// the janitor only scans the root directory
+		return errors.New(fmt.Sprintf("[%s] must not contain directories when retention is enabled: %s", confFilePattern, w.filePattern))
 	}
 	return nil
 }
 
+func (w *FileLogWriter) filePath(fileName string) string {
+	return filepath.Join(".", w.root, fileName)
+}
+
 func (w *FileLogWriter) syncAndClose(f *os.File) error {
 	var err error
 	if f != nil {
@@ -122,67 +230,149 @@ func (w *FileLogWriter) syncAndClose(f *os.File) error {
 
 // Destroy implements ILogWriter.Write
 func (w *FileLogWriter) Destroy() error {
+	// the stop channel is taken under the lock so that concurrent calls close it only once; background go routines
+	// may need the lock, so they are waited for without holding it
+	w.lock.Lock()
+	stop := w.stop
+	w.stop = nil
+	w.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		w.wg.Wait()
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
 	err := w.syncAndClose(w.currentFile)
+	w.currentFile = nil
 	return err
 }
 
 // RefreshConfig implements ILogWriter.RefreshConfig
-func (w *FileLogWriter) RefreshConfig(conf map[string]interface{}) error {
-	panic("implement me")
+//
+// The current file is closed and background go routines are restarted with the new configurations. Files being compressed
+// when the configurations are refreshed are re-scheduled for compression.
+func (w *FileLogWriter) RefreshConfig(confMap map[string]interface{}) error {
+	// validate new configurations before touching the running writer
+	conf := semita.NewSemita(confMap)
+	if err := (&FileLogWriter{category: w.category}).applyConfig(conf); err != nil {
+		return err
+	}
+	log.Printf("Refreshing FileLogWriter for category [%s]...", w.category)
+	if err := w.Destroy(); err != nil {
+		log.Printf("WARN: error closing file of category [%s]: %e", w.category, err)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	// file could be re-opened by a concurrent write
+	if err := w.syncAndClose(w.currentFile); err != nil {
+		log.Printf("WARN: error closing file of category [%s]: %e", w.category, err)
+	}
+	w.currentFile = nil
+	if err := w.applyConfig(conf); err != nil {
+		return err
+	}
+	return w.start()
+}
+
+// rollFileName returns name of the file that the current file is rolled to when it exceeds max file size: <current-file-name>.<n>
+func (w *FileLogWriter) rollFileName() string {
+	for {
+		w.rollIndex++
+		fileName := fmt.Sprintf("%s.%d", w.currentFileName, w.rollIndex)
+		if !w.fileExists(fileName) {
+			return fileName
+		}
+	}
+}
+
+// fileExists checks if a log file, or its compressed version, exists
+func (w *FileLogWriter) fileExists(fileName string) bool {
+	for _, ext := range []string{"", compressExtensions[compressGzip], compressExtensions[compressZstd]} {
+		if _, err := os.Stat(w.filePath(fileName + ext)); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollCurrentFile closes the current file and renames it to the next numbered suffix within the same time bucket.
+func (w *FileLogWriter) rollCurrentFile() error {
+	if err := w.syncAndClose(w.currentFile); err != nil {
+		return err
+	}
+	w.currentFile = nil
+	rollFileName := w.rollFileName()
+	log.Println(fmt.Sprintf("INFO: rolling file %s -> %s", w.currentFileName, rollFileName))
+	if err := os.Rename(w.filePath(w.currentFileName), w.filePath(rollFileName)); err != nil {
+		return err
+	}
+	w.scheduleCompress(rollFileName)
+	return nil
 }
 
-func (w *FileLogWriter) formatLogMessage(category, message string) []byte {
-	switch w.logType {
-	case logTypeTsv:
-		return []byte(category + SeparatorTsv + strings.TrimSpace(message))
-	case logTypeJson:
-		js, _ := json.Marshal(map[string]string{
-			"category": category,
-			"message":  strings.TrimSpace(message),
-		})
-		return js
+// openCurrentFile opens the current file for appending
+func (w *FileLogWriter) openCurrentFile() error {
+	f, err := os.OpenFile(w.filePath(w.currentFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.currentFile = f
+	w.currentFileSize = fi.Size()
+	log.Println(fmt.Sprintf("INFO: opened file %s", w.currentFileName))
 	return nil
 }
 
 // Write implements ILogWriter.Write
-func (w *FileLogWriter) Write(category, message string) error {
+func (w *FileLogWriter) Write(entry *LogEntry) error {
 	if !w.inited {
 		return errors.New("this log writer has not been initialized")
 	}
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	data := formatLogMessage(w.logType, entry)
+	if data == nil {
+		return errors.New("cannot format log message for writing")
+	}
+	data = append(data, '\n')
+
 	// rotate file if needed
 	fileName := time.Now().Format(w.filePattern)
-	if w.currentFileName != fileName && w.currentFile != nil {
-		log.Println(fmt.Sprintf("INFO: rotating file %s -> %s", w.currentFileName, fileName))
-		if err := w.syncAndClose(w.currentFile); err != nil {
-			return err
+	if w.currentFileName != fileName {
+		if w.currentFile != nil {
+			log.Println(fmt.Sprintf("INFO: rotating file %s -> %s", w.currentFileName, fileName))
+			if err := w.syncAndClose(w.currentFile); err != nil {
+				return err
+			}
+			w.currentFile = nil
+			w.scheduleCompress(w.currentFileName)
 		}
-		w.currentFile = nil
-		w.currentFileName = fileName
-	}
-	if w.currentFileName == "" {
 		w.currentFileName = fileName
+		w.rollIndex = 0
 	}
 
 	if w.currentFile == nil {
-		var err error
-		w.currentFile, err = os.OpenFile(w.root+"/"+w.currentFileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
+		if err := w.openCurrentFile(); err != nil {
 			return err
 		}
-		log.Println(fmt.Sprintf("INFO: opened file %s", w.currentFileName))
 	}
 
-	data := w.formatLogMessage(category, message)
-	if data == nil {
-		return errors.New("cannot format log message for writing")
-	}
-	_, err := w.currentFile.Write(data)
-	if err == nil {
-		_, err = w.currentFile.Write([]byte("\n"))
+	// roll file if it would exceed max file size
+	if w.maxFileSize > 0 && w.currentFileSize > 0 && w.currentFileSize+int64(len(data)) > w.maxFileSize {
+		if err := w.rollCurrentFile(); err != nil {
+			return err
+		}
+		if err := w.openCurrentFile(); err != nil {
+			return err
+		}
 	}
+
+	n, err := w.currentFile.Write(data)
+	w.currentFileSize += int64(n)
 	return err
 }
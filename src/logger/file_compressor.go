@@ -0,0 +1,182 @@
+package logger
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+
+	// suffix of files being compressed, they are removed on restart
+	compressTmpSuffix = ".tmp"
+
+	compressQueueSize = 1024
+)
+
+var (
+	compressExtensions = map[string]string{compressGzip: ".gz", compressZstd: ".zst"}
+
+	errCompressAborted = errors.New("compression aborted")
+)
+
+// stopReader wraps a reader and aborts reading as soon as stop is closed
+type stopReader struct {
+	r    io.Reader
+	stop chan struct{}
+}
+
+func (sr *stopReader) Read(p []byte) (int, error) {
+	select {
+	case <-sr.stop:
+		return 0, errCompressAborted
+	default:
+		return sr.r.Read(p)
+	}
+}
+
+// scheduleCompress queues a closed log file for compression. Caller must hold w.lock.
+func (w *FileLogWriter) scheduleCompress(fileName string) {
+	if w.compress == compressNone {
+		return
+	}
+	select {
+	case w.compressQueue <- fileName:
+		w.compressing[fileName] = true
+	default:
+		log.Printf("WARN: compression queue is full, file %s will be compressed on next restart", fileName)
+	}
+}
+
+// recoverCompress cleans up after compressions interrupted by a crash and re-schedules closed files that have not been compressed.
+func (w *FileLogWriter) recoverCompress() error {
+	fileList, err := ioutil.ReadDir(w.filePath(""))
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, fi := range fileList {
+		existing[fi.Name()] = true
+	}
+	bucketFileName := w.currentFileName
+	if bucketFileName == "" {
+		bucketFileName = time.Now().Format(w.filePattern)
+	}
+	ext := compressExtensions[w.compress]
+	for _, fi := range fileList {
+		fileName := fi.Name()
+		if !fi.Mode().IsRegular() || !w.fileRegexp.MatchString(fileName) {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(fileName, compressTmpSuffix):
+			// half-compressed file, the original file is still intact
+			log.Printf("INFO: removing incomplete compressed file %s", fileName)
+			if err := os.Remove(w.filePath(fileName)); err != nil {
+				return err
+			}
+		case isCompressedFileName(fileName):
+			// nothing to do
+		case existing[fileName+ext]:
+			// compressed file was completed but the original one was not removed
+			log.Printf("INFO: removing file %s, already compressed to %s", fileName, fileName+ext)
+			if err := os.Remove(w.filePath(fileName)); err != nil {
+				return err
+			}
+		case fileName != bucketFileName:
+			w.scheduleCompress(fileName)
+		}
+	}
+	return nil
+}
+
+func isCompressedFileName(fileName string) bool {
+	for _, ext := range compressExtensions {
+		if strings.HasSuffix(fileName, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// goCompress is the go routine that compresses closed log files until stop is closed.
+func (w *FileLogWriter) goCompress(stop chan struct{}) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case fileName := <-w.compressQueue:
+			if err := w.compressFile(fileName, stop); err != nil && err != errCompressAborted {
+				log.Printf("ERROR: error compressing file %s: %e", fileName, err)
+			}
+			w.lock.Lock()
+			delete(w.compressing, fileName)
+			w.lock.Unlock()
+		}
+	}
+}
+
+// compressFile compresses a closed log file to <file-name>.<ext>, then removes the original one.
+// The compressed content is written to a temp file first and renamed when completed, so that a crash never leaves a truncated compressed file behind.
+func (w *FileLogWriter) compressFile(fileName string, stop chan struct{}) error {
+	src := w.filePath(fileName)
+	dst := src + compressExtensions[w.compress]
+	tmp := dst + compressTmpSuffix
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := w.compressData(out, &stopReader{r: in, stop: stop}); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.syncAndClose(out); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Println(fmt.Sprintf("INFO: compressed file %s -> %s", fileName, fileName+compressExtensions[w.compress]))
+	in.Close()
+	return os.Remove(src)
+}
+
+func (w *FileLogWriter) compressData(out io.Writer, in io.Reader) error {
+	var enc io.WriteCloser
+	var err error
+	switch w.compress {
+	case compressGzip:
+		enc = gzip.NewWriter(out)
+	case compressZstd:
+		if enc, err = zstd.NewWriter(out); err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported compression [%s]", w.compress))
+	}
+	if _, err := io.Copy(enc, in); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,181 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Go datetime layout elements and regular expressions matching their formatted values.
+// Elements are ordered so that longer elements are matched before their prefixes.
+var layoutElements = []struct {
+	element string
+	regex   string
+}{
+	{"January", `[A-Za-z]+`}, {"Monday", `[A-Za-z]+`}, {"2006", `\d{4}`},
+	{"-07:00:00", `[-+]\d\d:\d\d:\d\d`}, {"-070000", `[-+]\d{6}`}, {"Z07:00:00", `(Z|[-+]\d\d:\d\d:\d\d)`}, {"Z070000", `(Z|[-+]\d{6})`},
+	{"-07:00", `[-+]\d\d:\d\d`}, {"-0700", `[-+]\d{4}`}, {"Z07:00", `(Z|[-+]\d\d:\d\d)`}, {"Z0700", `(Z|[-+]\d{4})`},
+	{"Jan", `[A-Za-z]{3}`}, {"Mon", `[A-Za-z]{3}`}, {"MST", `[A-Za-z0-9+-]+`},
+	{"002", `\d{3}`}, {"__2", `[ \d]{3}`}, {"-07", `[-+]\d\d`}, {"Z07", `(Z|[-+]\d\d)`},
+	{"06", `\d\d`}, {"01", `\d\d`}, {"02", `\d\d`}, {"_2", `[ \d]\d`}, {"15", `\d\d`}, {"03", `\d\d`}, {"04", `\d\d`}, {"05", `\d\d`},
+	{"PM", `[AP]M`}, {"pm", `[ap]m`},
+	{"1", `\d{1,2}`}, {"2", `\d{1,2}`}, {"3", `\d{1,2}`}, {"4", `\d{1,2}`}, {"5", `\d{1,2}`},
+}
+
+// filePatternToRegexp builds a regular expression that matches names of log files generated from a Go-style datetime file pattern,
+// including rolled files (<file-name>.<n>) and compressed files (<file-name>.gz, <file-name>.zst).
+func filePatternToRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for len(pattern) > 0 {
+		matched := false
+		for _, le := range layoutElements {
+			if strings.HasPrefix(pattern, le.element) {
+				sb.WriteString(le.regex)
+				pattern = pattern[len(le.element):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			sb.WriteString(regexp.QuoteMeta(pattern[:1]))
+			pattern = pattern[1:]
+		}
+	}
+	sb.WriteString(`(\.\d+)?(\.gz|\.zst)?(\.tmp)?$`)
+	return regexp.Compile(sb.String())
+}
+
+// fileRetention holds retention settings for log files of a FileLogWriter.
+type fileRetention struct {
+	maxAge       time.Duration // files older than this are cleaned up (0: no limit)
+	maxFiles     int           // max number of log files to keep (0: no limit)
+	maxTotalSize int64         // max total size of log files to keep (0: no limit)
+	archiveDir   string        // if not empty, files are moved to this directory instead of being deleted
+	interval     time.Duration // how often the janitor runs
+}
+
+func (r *fileRetention) enabled() bool {
+	return r.maxAge > 0 || r.maxFiles > 0 || r.maxTotalSize > 0
+}
+
+// goCleanup is the janitor go routine that periodically cleans up old log files until stop is closed.
+func (w *FileLogWriter) goCleanup(stop chan struct{}) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.retention.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.cleanup(); err != nil {
+			log.Printf("ERROR: error cleaning up log files for category [%s]: %e", w.category, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanup removes (or archives) log files that violate retention settings. The file currently being written and files being compressed are never touched.
+func (w *FileLogWriter) cleanup() error {
+	victims, err := w.selectCleanupVictims()
+	if err != nil {
+		return err
+	}
+	for _, fileName := range victims {
+		if err := w.removeFile(fileName); err != nil {
+			log.Printf("ERROR: error cleaning up log file %s: %e", fileName, err)
+		}
+	}
+	return nil
+}
+
+// selectCleanupVictims returns names of log files to be cleaned up, oldest first. Victims are selected while holding the
+// writer lock, so that files cannot be rotated, rolled or scheduled for compression in the meantime. Selected files
+// are already closed and not being compressed, hence they can be removed after the lock is released.
+func (w *FileLogWriter) selectCleanupVictims() ([]string, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	bucketFileName := time.Now().Format(w.filePattern)
+
+	fileList, err := ioutil.ReadDir(w.filePath(""))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0)
+	var totalSize int64 = 0
+	for _, fi := range fileList {
+		if fi.Mode().IsRegular() && w.fileRegexp.MatchString(fi.Name()) {
+			files = append(files, fi)
+			totalSize += fi.Size()
+		}
+	}
+	// oldest first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	victims := make([]string, 0)
+	numFiles := len(files)
+	now := time.Now()
+	for _, fi := range files {
+		if fi.Name() == w.currentFileName || fi.Name() == bucketFileName || w.compressing[fi.Name()] || strings.HasSuffix(fi.Name(), compressTmpSuffix) {
+			continue
+		}
+		expired := w.retention.maxAge > 0 && now.Sub(fi.ModTime()) > w.retention.maxAge
+		tooMany := w.retention.maxFiles > 0 && numFiles > w.retention.maxFiles
+		tooBig := w.retention.maxTotalSize > 0 && totalSize > w.retention.maxTotalSize
+		if !expired && !tooMany && !tooBig {
+			continue
+		}
+		victims = append(victims, fi.Name())
+		numFiles--
+		totalSize -= fi.Size()
+	}
+	return victims, nil
+}
+
+// removeFile deletes a log file, or moves it to the archive directory if configured
+func (w *FileLogWriter) removeFile(fileName string) error {
+	if w.retention.archiveDir == "" {
+		log.Println(fmt.Sprintf("INFO: deleting file %s", fileName))
+		return os.Remove(w.filePath(fileName))
+	}
+	log.Println(fmt.Sprintf("INFO: archiving file %s -> %s", fileName, w.retention.archiveDir))
+	return moveFile(w.filePath(fileName), filepath.Join(w.retention.archiveDir, fileName))
+}
+
+// moveFile moves a file, falling back to copy-then-delete if the file cannot be renamed (e.g. across devices)
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
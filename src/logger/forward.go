@@ -2,13 +2,21 @@ package logger
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/btnguyen2k/consu/reddo"
 	"github.com/btnguyen2k/consu/semita"
+	"github.com/klauspost/compress/zstd"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"io"
 	"io/ioutil"
 	"log"
 	pb "main/src/grpc"
@@ -37,16 +45,34 @@ type ForwardLogWriter struct {
 
 	destProtocol string                        // udp, grpc or http/https
 	udpAddr      *net.UDPAddr                  // for UDP destination
+	udpTimestamp bool                          // for UDP destination: prefix datagrams with timestamp of log entries
 	grpcConn     *grpc.ClientConn              // for gRPC client
 	grpcClient   pb.PLogCollectorServiceClient // for gRPC client
 	httpBase     string                        // for HTTP client
 	httpClient   *http.Client                  // for HTTP client
+	compress     string                        // compression of forwarded requests: gzip, zstd (http only) or none
+	timeout      time.Duration                 // timeout of forwarding requests (http and grpc)
+	tlsConfig    *tls.Config                   // for https and grpcs destinations
+	authHeaders  map[string]string             // credentials sent with forwarded requests as HTTP headers or gRPC metadata
 	lock         sync.Mutex
 	inited       bool
 }
 
 const (
-	confForwardDestination = "destination"
+	confForwardDestination     = "destination"
+	confForwardCompress        = "compress"
+	confForwardUdpTimestamp    = "udp_timestamp"
+	confForwardTimeout         = "timeout"
+	confForwardTlsCaFile       = "tls.ca_file"
+	confForwardTlsCertFile     = "tls.cert_file"
+	confForwardTlsKeyFile      = "tls.key_file"
+	confForwardTlsServerName   = "tls.server_name"
+	confForwardTlsInsecure     = "tls.insecure_skip_verify"
+	confForwardBearerToken     = "bearer_token"
+	confForwardApiKey          = "api_key"
+	confForwardApiKeyHeader    = "api_key_header"
+	defaultForwardTimeout      = 5 * time.Second
+	defaultForwardApiKeyHeader = "X-API-Key"
 )
 
 // Info implements ILogWriter.Info
@@ -55,6 +81,10 @@ func (w *ForwardLogWriter) Info() map[string]interface{} {
 		"name":          "forward",
 		"desc":          "This log writer forwards log messages to another prista instance",
 		"retry_seconds": w.retrySeconds,
+		"compress":      w.compress,
+		"timeout":       w.timeout.String(),
+		"tls":           w.tlsConfig != nil,
+		"udp_timestamp": w.udpTimestamp,
 	}
 }
 
@@ -64,54 +94,159 @@ func (w *ForwardLogWriter) Init(confMap map[string]interface{}) error {
 	defer w.lock.Unlock()
 	if !w.inited {
 		log.Printf("Intializing ForwardLogWriter for category [%s]...", w.category)
-		conf := semita.NewSemita(confMap)
-
-		// config: destination
-		if destination, err := conf.GetValueOfType(confForwardDestination, reddo.TypeString); err != nil {
+		if err := w.applyConfig(semita.NewSemita(confMap)); err != nil {
 			return err
-		} else {
-			w.destination = strings.TrimPrefix(strings.TrimSpace(destination.(string)), "")
-		}
-		if w.destination == "" {
-			return errors.New(fmt.Sprintf("no [%s] configuration defined", confForwardDestination))
 		}
-		if url, err := url.Parse(w.destination); err != nil {
+		w.inited = true
+	}
+	return nil
+}
+
+// applyConfig parses and applies log writer's configurations, connecting to destination if needed
+func (w *ForwardLogWriter) applyConfig(conf *semita.Semita) error {
+	// config: destination
+	if destination, err := conf.GetValueOfType(confForwardDestination, reddo.TypeString); err != nil {
+		return err
+	} else {
+		w.destination = strings.TrimSpace(destination.(string))
+	}
+	if w.destination == "" {
+		return errors.New(fmt.Sprintf("no [%s] configuration defined", confForwardDestination))
+	}
+	if url, err := url.Parse(w.destination); err != nil {
+		return err
+	} else if url == nil {
+		return errors.New(fmt.Sprintf("cannot parse destination [%s]", w.destination))
+	} else if url.Scheme != "udp" && url.Scheme != "grpc" && url.Scheme != "grpcs" && url.Scheme != "http" && url.Scheme != "https" {
+		return errors.New(fmt.Sprintf("unsupported destination [%s]", w.destination))
+	} else {
+		// config: timeout, tls and credentials
+		if err := w.applyConnConfig(conf, url.Scheme); err != nil {
 			return err
-		} else if url == nil {
-			return errors.New(fmt.Sprintf("cannot parse destination [%s]", w.destination))
-		} else if url.Scheme != "udp" && url.Scheme != "grpc" && url.Scheme != "http" && url.Scheme != "https" {
-			return errors.New(fmt.Sprintf("unsupported destination [%s]", w.destination))
-		} else {
-			switch url.Scheme {
-			case "udp":
-				w.destProtocol = "udp"
-				if udpAddr, err := net.ResolveUDPAddr("udp", url.Host); err != nil {
-					return err
-				} else {
-					w.udpAddr = udpAddr
-				}
-			case "grpc":
-				w.destProtocol = "grpc"
-				if conn, err := grpc.Dial(url.Host, grpc.WithInsecure()); err != nil {
-					return err
-				} else {
-					w.grpcConn = conn
-					w.grpcClient = pb.NewPLogCollectorServiceClient(w.grpcConn)
-				}
-			case "http", "https":
-				w.destProtocol = "http"
-				w.httpBase = url.Scheme + "://" + url.Host
-				w.httpClient = &http.Client{Timeout: 5 * time.Second}
+		}
+		switch url.Scheme {
+		case "udp":
+			w.destProtocol = "udp"
+			if udpAddr, err := net.ResolveUDPAddr("udp", url.Host); err != nil {
+				return err
+			} else {
+				w.udpAddr = udpAddr
 			}
+			// config: udp_timestamp
+			udpTimestamp, _ := conf.GetValueOfType(confForwardUdpTimestamp, reddo.TypeBool)
+			w.udpTimestamp = udpTimestamp != nil && udpTimestamp.(bool)
+		case "grpc", "grpcs":
+			w.destProtocol = "grpc"
+			dialOpt := grpc.WithInsecure()
+			if w.tlsConfig != nil {
+				dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(w.tlsConfig))
+			}
+			if conn, err := grpc.Dial(url.Host, dialOpt); err != nil {
+				return err
+			} else {
+				w.grpcConn = conn
+				w.grpcClient = pb.NewPLogCollectorServiceClient(w.grpcConn)
+			}
+		case "http", "https":
+			w.destProtocol = "http"
+			w.httpBase = url.Scheme + "://" + url.Host
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = w.tlsConfig
+			w.httpClient = &http.Client{Timeout: w.timeout, Transport: transport}
 		}
+	}
 
-		if retrySeconds, err := conf.GetValueOfType(ConfRetrySeconds, reddo.TypeInt); err != nil {
-			w.retrySeconds = DefaultRetrySeconds
-		} else {
-			w.retrySeconds = int(retrySeconds.(int64))
+	// config: compress
+	compress, _ := conf.GetValueOfType(confForwardCompress, reddo.TypeString)
+	if compress == nil || strings.TrimSpace(compress.(string)) == "" {
+		compress = compressNone
+	}
+	w.compress = strings.ToLower(strings.TrimSpace(compress.(string)))
+	switch {
+	case w.compress == compressNone:
+	case w.destProtocol == "http" && (w.compress == compressGzip || w.compress == compressZstd):
+	case w.destProtocol == "grpc" && w.compress == compressGzip:
+	default:
+		return errors.New(fmt.Sprintf("compression [%s] is not supported for destination [%s]", w.compress, w.destination))
+	}
+
+	if retrySeconds, err := conf.GetValueOfType(ConfRetrySeconds, reddo.TypeInt); err != nil || retrySeconds == nil {
+		w.retrySeconds = DefaultRetrySeconds
+	} else {
+		w.retrySeconds = int(retrySeconds.(int64))
+	}
+	return nil
+}
+
+// applyConnConfig parses timeout, TLS settings and credentials used to connect to destination
+func (w *ForwardLogWriter) applyConnConfig(conf *semita.Semita, scheme string) error {
+	var err error
+	if w.timeout, err = getConfDuration(conf, confForwardTimeout, defaultForwardTimeout); err != nil {
+		return err
+	} else if w.timeout <= 0 {
+		return errors.New(fmt.Sprintf("invalid [%s] configuration: must be positive", confForwardTimeout))
+	}
+
+	// config: tls
+	getString := func(key string) string {
+		v, _ := conf.GetValueOfType(key, reddo.TypeString)
+		if v == nil {
+			return ""
+		}
+		return strings.TrimSpace(v.(string))
+	}
+	caFile, certFile, keyFile := getString(confForwardTlsCaFile), getString(confForwardTlsCertFile), getString(confForwardTlsKeyFile)
+	serverName := getString(confForwardTlsServerName)
+	insecure, _ := conf.GetValueOfType(confForwardTlsInsecure, reddo.TypeBool)
+	insecureSkipVerify := insecure != nil && insecure.(bool)
+	useTls := scheme == "https" || scheme == "grpcs"
+	if !useTls && (caFile != "" || certFile != "" || keyFile != "" || serverName != "" || insecureSkipVerify) {
+		return errors.New(fmt.Sprintf("tls configurations require an https:// or grpcs:// destination, got [%s]", w.destination))
+	}
+	if useTls {
+		w.tlsConfig = &tls.Config{ServerName: serverName, InsecureSkipVerify: insecureSkipVerify, MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return err
+			}
+			w.tlsConfig.RootCAs = x509.NewCertPool()
+			if !w.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return errors.New(fmt.Sprintf("no valid CA certificate found in [%s]", caFile))
+			}
+		}
+		if certFile != "" || keyFile != "" {
+			if certFile == "" || keyFile == "" {
+				return errors.New(fmt.Sprintf("both [%s] and [%s] must be configured to use a client certificate", confForwardTlsCertFile, confForwardTlsKeyFile))
+			}
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return err
+			}
+			w.tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if insecureSkipVerify {
+			log.Printf("WARN: ForwardLogWriter for category [%s] does not verify certificate of destination [%s]", w.category, w.destination)
 		}
+	}
 
-		w.inited = true
+	// config: bearer_token, api_key and api_key_header
+	w.authHeaders = make(map[string]string)
+	if token := getString(confForwardBearerToken); token != "" {
+		w.authHeaders["Authorization"] = "Bearer " + token
+	}
+	if apiKey := getString(confForwardApiKey); apiKey != "" {
+		header := getString(confForwardApiKeyHeader)
+		if header == "" {
+			header = defaultForwardApiKeyHeader
+		}
+		w.authHeaders[header] = apiKey
+	}
+	if len(w.authHeaders) > 0 && scheme == "udp" {
+		return errors.New(fmt.Sprintf("[%s] and [%s] are not supported for destination [%s]", confForwardBearerToken, confForwardApiKey, w.destination))
+	}
+	if len(w.authHeaders) > 0 && !useTls {
+		log.Printf("WARN: ForwardLogWriter for category [%s] sends credentials in cleartext to destination [%s]", w.category, w.destination)
 	}
 	return nil
 }
@@ -126,18 +261,75 @@ func (w *ForwardLogWriter) Destroy() error {
 }
 
 // RefreshConfig implements ILogWriter.RefreshConfig
-func (w *ForwardLogWriter) RefreshConfig(conf map[string]interface{}) error {
-	panic("implement me")
+func (w *ForwardLogWriter) RefreshConfig(confMap map[string]interface{}) error {
+	// new configurations are applied to a new instance first, so that the current one keeps working if they are invalid
+	newW := &ForwardLogWriter{category: w.category}
+	if err := newW.applyConfig(semita.NewSemita(confMap)); err != nil {
+		newW.Destroy()
+		return err
+	}
+	log.Printf("Refreshing ForwardLogWriter for category [%s]...", w.category)
+	w.lock.Lock()
+	oldGrpcConn := w.grpcConn
+	w.destination, w.retrySeconds, w.destProtocol, w.compress = newW.destination, newW.retrySeconds, newW.destProtocol, newW.compress
+	w.timeout, w.tlsConfig, w.authHeaders = newW.timeout, newW.tlsConfig, newW.authHeaders
+	w.udpAddr, w.udpTimestamp, w.grpcConn, w.grpcClient, w.httpBase, w.httpClient = newW.udpAddr, newW.udpTimestamp, newW.grpcConn, newW.grpcClient, newW.httpBase, newW.httpClient
+	w.lock.Unlock()
+	if oldGrpcConn != nil {
+		return oldGrpcConn.Close()
+	}
+	return nil
+}
+
+// newHttpRequest builds the HTTP request to forward a log entry, compressing request body if configured
+func (w *ForwardLogWriter) newHttpRequest(url string, js []byte) (*http.Request, error) {
+	body := bytes.NewBuffer(nil)
+	var enc io.WriteCloser
+	switch w.compress {
+	case compressGzip:
+		enc = gzip.NewWriter(body)
+	case compressZstd:
+		var err error
+		if enc, err = zstd.NewWriter(body); err != nil {
+			return nil, err
+		}
+	}
+	if enc != nil {
+		if _, err := enc.Write(js); err != nil {
+			enc.Close()
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+	} else {
+		body.Write(js)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.authHeaders {
+		req.Header.Set(k, v)
+	}
+	if enc != nil {
+		req.Header.Set("Content-Encoding", w.compress)
+	}
+	return req, nil
 }
 
 // Write implements ILogWriter.Write
-func (w *ForwardLogWriter) Write(category, message string) error {
+func (w *ForwardLogWriter) Write(entry *LogEntry) error {
 	if !w.inited {
 		return errors.New("this log writer has not been initialized")
 	}
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	category, message := entry.Category, entry.Message
+	timestamp := entry.Timestamp.UnixNano() / int64(time.Millisecond)
+
 	switch w.destProtocol {
 	case "udp":
 		if conn, err := net.DialUDP("udp", nil, w.udpAddr); err != nil {
@@ -145,21 +337,40 @@ func (w *ForwardLogWriter) Write(category, message string) error {
 		} else {
 			defer conn.Close()
 			buff := []byte(category + SeparatorTsv + message)
+			if w.udpTimestamp {
+				// opt-in: receivers that do not support timestamp prefix would take the timestamp as category name
+				buff = []byte(formatTimestamp(entry.Timestamp) + SeparatorTsv + category + SeparatorTsv + message)
+			}
 			_, err := conn.Write(buff)
 			return err
 		}
 	case "grpc":
-		if result, err := w.grpcClient.Log(context.Background(), &pb.PLogMessage{Category: category, Message: message}); err != nil {
+		var opts []grpc.CallOption
+		if w.compress == compressGzip {
+			opts = append(opts, grpc.UseCompressor(grpcgzip.Name))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		defer cancel()
+		for k, v := range w.authHeaders {
+			ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(k), v)
+		}
+		if result, err := w.grpcClient.Log(ctx, &pb.PLogMessage{Category: category, Message: message, Timestamp: timestamp, Fields: entry.Fields}, opts...); err != nil {
 			return err
 		} else if result.Status != 200 {
 			return errors.New(fmt.Sprintf("error while forwarding message via gRPC. Status: %d / Category: %s / Message: %s", result.Status, category, message))
 		}
 	case "http", "https":
 		url := w.httpBase + "/api/log"
-		data := map[string]string{"category": category, "message": message}
+		data := map[string]interface{}{"category": category, "message": message, "timestamp": timestamp}
+		if len(entry.Fields) > 0 {
+			data["fields"] = entry.Fields
+		}
 		js, _ := json.Marshal(data)
-		body := bytes.NewBuffer(js)
-		if resp, err := w.httpClient.Post(url, "application/json", body); err != nil {
+		req, err := w.newHttpRequest(url, js)
+		if err != nil {
+			return err
+		}
+		if resp, err := w.httpClient.Do(req); err != nil {
 			return err
 		} else {
 			defer resp.Body.Close()
@@ -1,28 +1,73 @@
 package logger
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/btnguyen2k/consu/reddo"
 	"github.com/btnguyen2k/consu/semita"
+	"main/src/utils"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	DefaultRetrySeconds = 60
 	SeparatorTsv        = "\t"
+	TimestampLayout     = "2006-01-02T15:04:05.000Z07:00"
 	ConfRetrySeconds    = "retry_seconds"
+	ConfPriority        = "priority"
+
+	logTypeTsv     = "tsv"
+	logTypeJson    = "json"
+	defaultLogType = logTypeJson
 )
 
 // LogWriterAndInfo encapsulates a log writer instance and other configuration info
 type LogWriterAndInfo struct {
 	LogWriter    ILogWriter
+	Type         string // writer type, e.g. "console" or "file"
 	RetrySeconds int64
+	RetryBackoff RetryBackoff
+	Breaker      *CircuitBreaker // nil if circuit breaker is disabled
+	Concurrency  Concurrency
+	Priority     int // buffered entries of lower priority categories are dropped first when buffer is full (see buffer.overflow_policy)
+	Delivery     Delivery
+	InFlight     *sync.WaitGroup // writes in progress with LogWriter, shared by all LogWriterAndInfo wrapping the same writer
+}
+
+// ParsePriority parses priority of a category from log writer configurations (default 0)
+func ParsePriority(conf map[string]interface{}) (int, error) {
+	v, ok := conf[ConfPriority]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	priority, err := reddo.ToInt(v)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid [%s]: %s", ConfPriority, err))
+	}
+	return int(priority), nil
+}
+
+// Info returns log writer's attributes (see ILogWriter.Info), plus delivery mode as "delivery" and state of the circuit
+// breaker as "circuit_breaker" (if enabled)
+func (lwi *LogWriterAndInfo) Info() map[string]interface{} {
+	info := make(map[string]interface{})
+	for k, v := range lwi.LogWriter.Info() {
+		info[k] = v
+	}
+	info[ConfDelivery] = lwi.Delivery.Mode
+	if lwi.Breaker != nil {
+		info[ConfCircuitBreaker] = lwi.Breaker.State()
+	}
+	return info
 }
 
 // FuncEnqueue is a function that enqueues a log entry
 // @available since v0.1.3
-type FuncEnqueue func(payload []byte, throttling bool) error
+type FuncEnqueue func(entry *LogEntry, throttling bool) error
 
 // ILogWriter defines API to write log message.
 type ILogWriter interface {
@@ -42,41 +87,124 @@ type ILogWriter interface {
 	// RefreshConfig updates writer's configuration live.
 	RefreshConfig(conf map[string]interface{}) error
 
-	// Write writes a log message to a category
-	Write(category, message string) error
+	// Write writes a log entry to its category
+	Write(entry *LogEntry) error
 }
 
 // NewLogWriter creates a new log writer instance, initialized and ready for use.
 //	- cat: log category name
 //	- conf: log writer configurations
 func NewLogWriter(cat string, confMap map[string]interface{}, enqueueFunc FuncEnqueue) (ILogWriter, error) {
-	typeMap := reflect.TypeOf(map[string]interface{}{})
-	conf := semita.NewSemita(confMap)
-	wrtType, err := conf.GetValueOfType("type", reddo.TypeString)
+	wrtType, writerConf, err := writerConfig(confMap)
 	if err != nil {
 		return nil, err
 	}
-	switch wrtType.(string) {
+	switch wrtType {
+	case "console":
+		return NewConsoleLogWriter(cat, writerConf)
 	case "file":
-		if confFile, err := conf.GetValueOfType("file", typeMap); err != nil {
-			return nil, err
-		} else {
-			return NewFileLogWriter(cat, confFile.(map[string]interface{}))
-		}
+		return NewFileLogWriter(cat, writerConf)
 	case "forward":
-		if confForward, err := conf.GetValueOfType("forward", typeMap); err != nil {
-			return nil, err
-		} else {
-			return NewForwardLogWriter(cat, confForward.(map[string]interface{}))
-		}
+		return NewForwardLogWriter(cat, writerConf)
 	case "fanout":
-		if confFanout, err := conf.GetValueOfType("fanout", typeMap); err != nil {
-			return nil, err
-		} else {
-			return NewFanoutLogWriter(cat, confFanout.(map[string]interface{}), enqueueFunc)
-		}
+		return NewFanoutLogWriter(cat, writerConf, enqueueFunc)
 	default:
 		return nil, errors.New(fmt.Sprintf("unknown writer type [%s]", wrtType))
 	}
-	return nil, nil
+}
+
+// RefreshLogWriter updates configurations of an existing log writer live. Log writer's type can not be changed.
+//	- writer: the log writer to refresh
+//	- conf: new log writer configurations, same structure as of NewLogWriter
+func RefreshLogWriter(writer ILogWriter, confMap map[string]interface{}) error {
+	wrtType, writerConf, err := writerConfig(confMap)
+	if err != nil {
+		return err
+	}
+	if name := writer.Info()["name"]; name != wrtType {
+		return errors.New(fmt.Sprintf("cannot change writer type from [%v] to [%s]", name, wrtType))
+	}
+	return writer.RefreshConfig(writerConf)
+}
+
+// writerConfig extracts writer type and writer's specific configurations (the block named after writer type) from log writer configurations
+func writerConfig(confMap map[string]interface{}) (string, map[string]interface{}, error) {
+	conf := semita.NewSemita(confMap)
+	wrtType, err := conf.GetValueOfType("type", reddo.TypeString)
+	if err != nil {
+		return "", nil, err
+	}
+	switch wrtType.(string) {
+	case "console", "file", "forward", "fanout":
+	default:
+		return "", nil, errors.New(fmt.Sprintf("unknown writer type [%s]", wrtType))
+	}
+	writerConf, err := conf.GetValueOfType(wrtType.(string), reflect.TypeOf(map[string]interface{}{}))
+	if err != nil || writerConf == nil {
+		if wrtType.(string) == "console" {
+			// all "console" configurations are optional
+			return wrtType.(string), map[string]interface{}{}, nil
+		}
+		if err == nil {
+			err = errors.New(fmt.Sprintf("no [%s] configuration defined", wrtType))
+		}
+		return "", nil, err
+	}
+	return wrtType.(string), writerConf.(map[string]interface{}), nil
+}
+
+// formatLogMessage formats a log entry for writing, according to log type
+//	- tsv: <timestamp><tab-character><category-name><tab-character><log-message>
+//	- json: {"timestamp":<timestamp>, "category":<category-name>, "message": <log-message>, "fields": <extra-fields-if-any>}
+func formatLogMessage(logType string, entry *LogEntry) []byte {
+	switch logType {
+	case logTypeTsv:
+		return []byte(formatTimestamp(entry.Timestamp) + SeparatorTsv + entry.Category + SeparatorTsv + strings.TrimSpace(entry.Message))
+	case logTypeJson:
+		data := map[string]interface{}{
+			"timestamp": formatTimestamp(entry.Timestamp),
+			"category":  entry.Category,
+			"message":   strings.TrimSpace(entry.Message),
+		}
+		if len(entry.Fields) > 0 {
+			data["fields"] = entry.Fields
+		}
+		js, _ := json.Marshal(data)
+		return js
+	}
+	return nil
+}
+
+// formatTimestamp formats a timestamp in application's timezone using TimestampLayout
+func formatTimestamp(t time.Time) string {
+	if utils.Location != nil {
+		t = t.In(utils.Location)
+	}
+	return t.Format(TimestampLayout)
+}
+
+// getConfByteSize reads an optional size-in-bytes configuration (HOCON format), returning defaultValue if not configured
+func getConfByteSize(conf *semita.Semita, key string, defaultValue int64) (int64, error) {
+	v, _ := conf.GetValueOfType(key, reddo.TypeString)
+	if v == nil || strings.TrimSpace(v.(string)) == "" {
+		return defaultValue, nil
+	}
+	result, err := utils.ParseByteSize(v.(string))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid [%s] configuration: %s", key, err))
+	}
+	return result, nil
+}
+
+// getConfDuration reads an optional duration configuration (HOCON format), returning defaultValue if not configured
+func getConfDuration(conf *semita.Semita, key string, defaultValue time.Duration) (time.Duration, error) {
+	v, _ := conf.GetValueOfType(key, reddo.TypeString)
+	if v == nil || strings.TrimSpace(v.(string)) == "" {
+		return defaultValue, nil
+	}
+	result, err := utils.ParseDuration(v.(string))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid [%s] configuration: %s", key, err))
+	}
+	return result, nil
 }
@@ -1,21 +1,21 @@
 package prista
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"github.com/btnguyen2k/consu/reddo"
-	"github.com/btnguyen2k/consu/semita"
 	"github.com/btnguyen2k/singu"
-	"github.com/btnguyen2k/singu/leveldb"
 	"github.com/go-akka/configuration"
-	"golang.org/x/sync/semaphore"
 	"log"
 	"main/src/logger"
 	"main/src/utils"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -38,7 +38,8 @@ Start bootstraps the application.
 */
 func Start() {
 	var err error
-	AppConfig = initAppConfig()
+	var configFiles []string
+	AppConfig, configFiles = initAppConfig()
 	utils.Location, err = time.LoadLocation(AppConfig.GetString("timezone"))
 	if err != nil {
 		panic(err)
@@ -46,23 +47,21 @@ func Start() {
 
 	LogConfig = AppConfig.GetConfig("log")
 
-	Buffer = initBuffer(LogConfig)
-
 	LogWriters = initLogWriters(LogConfig)
-	if LogWriters == nil {
-		panic("no valid log writer configured")
-	}
-	if _, ok := LogWriters["default"]; !ok {
-		panic("no valid log writer for 'default' category")
-	}
+	// log writers must be initialized before buffer, which routes log entries to category queues by their log writers
+	Buffer = initBuffer(AppConfig)
+	DeadLetters = initDeadLetterStore(AppConfig)
+	go goWatchConfig(configFiles, AppConfig.GetTimeDuration("config_watch_interval", defaultConfigWatchInterval))
 
 	maxWriteThreads := AppConfig.GetInt64("max_write_threads", defaultMaxWriteThreads)
 	if maxWriteThreads < 1 {
 		maxWriteThreads = defaultMaxWriteThreads
 	}
-	go goWriteLogs(Buffer, maxWriteThreads)
+	writeSched = newWriteScheduler(int(maxWriteThreads))
+	go goWriteLogs(Buffer, writeSched)
 	go goProcessOrphanLogs(Buffer)
 
+	Auth = initAuth(AppConfig)
 	var wg sync.WaitGroup
 	if initHttpServer(&wg) {
 		wg.Add(1)
@@ -77,144 +76,530 @@ func Start() {
 	if initGrpcServer(&wg) {
 		wg.Add(1)
 	}
-	wg.Wait()
+	if initTcpServer(&wg) {
+		wg.Add(1)
+	}
+	// syslog server registers its own listeners to the wait group
+	initSyslogServer(&wg)
+
+	serversDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(serversDone)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("INFO: signal [%s] received, shutting down...", sig)
+	case <-serversDone:
+		log.Printf("INFO: all servers stopped, shutting down...")
+	}
+	shutdown(AppConfig.GetTimeDuration("shutdown_timeout", defaultShutdownTimeout))
 
 	fmt.Printf("Application exists.")
 }
 
 const defaultConfigFile = "./config/application.conf"
 
-func initAppConfig() *configuration.Config {
-	configFile := os.Getenv("APP_CONFIG")
-	if configFile == "" {
+func initAppConfig() (*configuration.Config, []string) {
+	appConfigFile = os.Getenv("APP_CONFIG")
+	if appConfigFile == "" {
 		log.Printf("No environment APP_CONFIG found, fallback to [%s]", defaultConfigFile)
-		configFile = defaultConfigFile
+		appConfigFile = defaultConfigFile
 	}
-	return loadAppConfig(configFile)
-}
-
-func initBuffer(config *configuration.Config) singu.IQueue {
-	tempDir := config.GetString("temp_dir", "./temp")
-	return leveldb.NewLeveldbQueue("buffer", tempDir, 0, false, 0)
+	return loadAppConfigFiles(appConfigFile)
 }
 
 // Go routine to requeue orphan messages
 func goProcessOrphanLogs(buffer singu.IQueue) {
+	defer close(orphanLogsDone)
 	for {
-		time.Sleep(11 * time.Second)
-		if msgList, err := buffer.OrphanMessages(10, 1000); err != nil {
+		select {
+		case <-shuttingDown:
+			return
+		case <-time.After(11 * time.Second):
+		}
+		// ephemeral storage also holds messages waiting for their next attempts, they are skipped
+		allMsgs, err := buffer.OrphanMessages(10, 1000)
+		if err != nil {
 			log.Printf(fmt.Sprintf("ERROR: error fetchig orphan messages: %e", err))
-		} else if len(msgList) > 0 {
+			continue
+		}
+		msgList := make([]*singu.QueueMessage, 0, len(allMsgs))
+		for _, msg := range allMsgs {
+			if !isDelayedRetry(msg.Id) && !writeSched.isScheduled(msg.Id) {
+				msgList = append(msgList, msg)
+			}
+		}
+		metricOrphanMessages.Set(float64(len(msgList)))
+		if len(msgList) > 0 {
 			log.Printf(fmt.Sprintf("INFO: processing %d orphan messages...", len(msgList)))
 			for _, msg := range msgList {
+				if isShuttingDown() {
+					return
+				}
 				if _, err := buffer.Requeue(msg.Id, false); err != nil {
 					log.Printf(fmt.Sprintf("ERROR: error requeueing orphan message %s/%s: %e", msg.Id, string(msg.Payload), err))
+				} else {
+					metricOrphanRequeued.Inc()
 				}
 			}
 		}
 	}
 }
 
-func getLogWriter(cat string) *logger.LogWriterAndInfo {
+// getLogWriter returns the log writer handling a category, which is the category's own writer or the "default" one
+// (the category of the returned writer is returned as well).
+func getLogWriter(cat string) (string, *logger.LogWriterAndInfo) {
+	logWritersLock.RLock()
+	defer logWritersLock.RUnlock()
+	return findLogWriter(cat)
+}
+
+// acquireLogWriter returns the log writer handling a category (see getLogWriter) and counts a write in flight with it:
+// the writer is not destroyed when configurations are reloaded until lwi.InFlight.Done() is called
+func acquireLogWriter(cat string) (string, *logger.LogWriterAndInfo) {
+	logWritersLock.RLock()
+	defer logWritersLock.RUnlock()
+	cat, lwi := findLogWriter(cat)
+	if lwi != nil {
+		lwi.InFlight.Add(1)
+	}
+	return cat, lwi
+}
+
+// findLogWriter looks up the log writer handling a category, caller must hold logWritersLock
+func findLogWriter(cat string) (string, *logger.LogWriterAndInfo) {
 	lwi := LogWriters[cat]
 	if lwi == nil {
-		lwi = LogWriters["default"]
+		cat, lwi = "default", LogWriters["default"]
+	}
+	return cat, lwi
+}
+
+// categoryDirName returns name of the directory storing data of a category (e.g. its buffer or dead letters), which is
+// safe to be used as a path element: bytes other than letters, digits, "_", "-" and "." (except a leading ".") are escaped
+// as %XX, so that distinct categories are never stored in the same directory (see categoryFromDirName)
+func categoryDirName(category string) string {
+	var sb strings.Builder
+	for i := 0; i < len(category); i++ {
+		c := category[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' && i > 0 {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
 	}
-	return lwi
+	return sb.String()
 }
 
-// Go routine to fetch messages from buffer and send to log writer
-func goWriteLogs(buffer singu.IQueue, maxThreads int64) {
-	sema := semaphore.NewWeighted(maxThreads)
+// categoryFromDirName returns the category whose data is stored in a directory, false if the directory name is not one
+// returned by categoryDirName
+func categoryFromDirName(name string) (string, bool) {
+	category, err := url.PathUnescape(name)
+	return category, err == nil && category != "" && categoryDirName(category) == name
+}
+
+// Go routine to fetch messages from buffer and send to log writer, stops taking messages from buffer when the application shuts down.
+// Write slots are shared among categories by the scheduler (see writeScheduler).
+func goWriteLogs(buffer singu.IQueue, sched *writeScheduler) {
+	defer close(writeLogsDone)
 	var counterSuccess int64 = 0
+	start := func(job *writeJob) {
+		writesWg.Add(1)
+		go func() {
+			defer writesWg.Done()
+			defer sched.release(job)
+			writeLogMessage(buffer, job.msg, job.entry, &counterSuccess)
+		}()
+	}
 	for {
-		time.Sleep(1 * time.Second)
-		var counterAll, markSuccess int64 = 0, counterSuccess
+		select {
+		case <-shuttingDown:
+		case <-time.After(1 * time.Second):
+		}
+		if stopTakingLogs(buffer, sched) {
+			return
+		}
+		var counterAll, markSuccess int64 = 0, atomic.LoadInt64(&counterSuccess)
 		t1 := time.Now()
-		for {
-			ctx, _ := context.WithTimeout(context.Background(), 1*time.Second)
-			if err := sema.Acquire(ctx, 1); err == nil {
-				if msg, err := buffer.Take(); err == nil && msg != nil {
-					atomic.AddInt64(&counterAll, 1)
-					go func(msg *singu.QueueMessage, counterSuccess *int64, sema *semaphore.Weighted) {
-						defer sema.Release(1)
-						tokens := strings.Split(string(msg.Payload), logger.SeparatorTsv)
-						var finish = true
-						if len(tokens) == 2 {
-							lwi := getLogWriter(tokens[0])
-							if lwi == nil {
-								log.Printf(fmt.Sprintf("WARM: no log writer found for category [%s]", tokens[0]))
-							} else if err := lwi.LogWriter.Write(tokens[0], tokens[1]); err != nil {
-								log.Printf(fmt.Sprintf("ERROR: error writing log to [%s]: %e", tokens[0], err))
-								if lwi.RetrySeconds < 0 || msg.Timestamp.Unix()+lwi.RetrySeconds >= time.Now().Unix() {
-									// set finish=false to requeue if message has not been queued for 'RetrySeconds'
-									finish = false
-								}
-							} else {
-								atomic.AddInt64(counterSuccess, 1)
-							}
-						}
-						if finish {
-							if err := buffer.Finish(msg.Id); err != nil {
-								log.Printf(fmt.Sprintf("ERROR: error finishing message %s/%s: %e", msg.Id, string(msg.Payload), err))
-							}
-						} else if _, err := buffer.Requeue(msg.Id, false); err != nil {
-							log.Printf(fmt.Sprintf("ERROR: error requeueing message %s/%s: %e", msg.Id, string(msg.Payload), err))
-						}
-					}(msg, &counterSuccess, sema)
-				} else {
-					sema.Release(1)
+		for !stopTakingLogs(buffer, sched) {
+			sched.dispatch(start)
+			numTaken, numSkipped := 0, 0
+			if cq, ok := buffer.(categoryQueues); ok && cq.categories() != nil {
+				numTaken, numSkipped = takeCategories(buffer, cq, sched, start)
+			} else {
+				for !stopTakingLogs(buffer, sched) && sched.hasRoom() && numSkipped < sched.maxThreads {
+					msg, err := buffer.Take()
+					if err != nil || msg == nil {
+						break
+					}
+					numTaken++
+					numSkipped += scheduleMessage(buffer, msg, sched, start)
 				}
 			}
+			counterAll += int64(numTaken)
+			if numTaken == 0 || numSkipped > 0 || !sched.hasRoom() {
+				// nothing to take from buffer, or no room for more pending writes
+				sched.wait(100 * time.Millisecond)
+			}
 			if ConcurrentWrite > 0 && counterAll >= 100/(ConcurrentWrite+1) || time.Now().Unix()-t1.Unix() >= 10 {
 				// throttle [buffer->log-writer] rate
 				break
 			}
 		}
-		if counterSuccess-markSuccess > 0 {
-			log.Printf(fmt.Sprintf("INFO: %d log(s) written, %d accumulated", counterSuccess-markSuccess, counterSuccess))
+		if numSuccess := atomic.LoadInt64(&counterSuccess); numSuccess-markSuccess > 0 {
+			log.Printf(fmt.Sprintf("INFO: %d log(s) written, %d accumulated", numSuccess-markSuccess, numSuccess))
 		}
 	}
 }
 
-func initLogWriters(config *configuration.Config) map[string]*logger.LogWriterAndInfo {
-	if config != nil && config.Root().IsObject() {
-		result := make(map[string]*logger.LogWriterAndInfo)
-		for cat, conf := range config.Root().GetObject().Items() {
-			if conf != nil && conf.IsObject() {
-				cat = strings.ToLower(cat)
-				writerConf := utils.UnwrapHocon(conf)
-				if writer, err := logger.NewLogWriter(cat, writerConf.(map[string]interface{}), handleIncomingMessage); err != nil {
-					panic(err)
-				} else {
-					lwi := logger.LogWriterAndInfo{LogWriter: writer}
-					wInfo := writer.Info()
-					info := semita.NewSemita(wInfo)
-					retrySeconds, err := info.GetValueOfType(logger.ConfRetrySeconds, reddo.TypeInt)
-					if err != nil || retrySeconds == nil {
-						retrySeconds = logger.DefaultRetrySeconds
-					}
-					lwi.RetrySeconds = retrySeconds.(int64)
-					result[cat] = &lwi
-				}
-			} else {
-				panic(fmt.Sprintf("invalid config for log writer [%s]: %v", cat, conf))
+// takeCategories takes messages from per-category buffer: each category is taken independently, as long as the log writer
+// handling it has room for more pending writes. Returns number of messages taken, and number of them put back to buffer.
+// One loop over all categories is enough: taking a message is a local read from buffer, writes run in their own goroutines
+// (a slow log writer only fills up its own pending writes, which makes the loop skip its categories), and the order in
+// which pending writes start is decided by the scheduler anyway.
+func takeCategories(buffer singu.IQueue, cq categoryQueues, sched *writeScheduler, start func(job *writeJob)) (int, int) {
+	numTaken, numSkipped := 0, 0
+	for _, cat := range cq.categories() {
+		// pending writes are keyed by category of the log writer, which is "default" for categories without their own writer
+		writerCat, _ := getLogWriter(cat)
+		if isCircuitOpen(writerCat) {
+			// entries of the category stay in buffer until its circuit breaker allows writes again
+			continue
+		}
+		for !stopTakingLogs(buffer, sched) && sched.hasRoom() && !sched.isFull(writerCat, writerConcurrency(sched, writerCat)) {
+			msg, err := cq.takeFrom(cat)
+			if err == nil && msg == nil && writerCat != cat {
+				// queue of a category without its own log writer is drained, it is removed until needed again
+				cq.removeIdle(cat)
+			}
+			if err != nil || msg == nil {
+				break
+			}
+			numTaken++
+			if scheduleMessage(buffer, msg, sched, start) > 0 {
+				// the message is put back to the category's queue, taking it again right away would return the same message
+				numSkipped++
+				break
+			}
+		}
+	}
+	return numTaken, numSkipped
+}
+
+// stopTakingLogs returns true if goWriteLogs should stop taking messages from buffer. When the application shuts down,
+// persistent buffer stops immediately (buffered messages are written on next start), while non-persistent buffer is
+// drained first (until shutdown_timeout is over).
+func stopTakingLogs(buffer singu.IQueue, sched *writeScheduler) bool {
+	if !isShuttingDown() {
+		return false
+	}
+	if bufferPersistent || isBufferClosed() {
+		return true
+	}
+	queueSize, err := buffer.QueueSize()
+	return err != nil || queueSize <= 0 && sched.numPending() == 0
+}
+
+// writerConcurrency returns write concurrency of the log writer handling a category, with max_threads resolved by the scheduler
+func writerConcurrency(sched *writeScheduler, cat string) logger.Concurrency {
+	logWritersLock.RLock()
+	_, lwi := findLogWriter(cat)
+	numCategories := len(LogWriters)
+	logWritersLock.RUnlock()
+	concurrency := logger.Concurrency{}
+	if lwi != nil {
+		concurrency = lwi.Concurrency
+	}
+	return sched.fairShare(concurrency, numCategories)
+}
+
+// scheduleMessage puts a message taken from buffer to the scheduler and starts writes if there are free slots.
+// Returns 1 if the message's category already has enough pending writes and the message is put back to buffer, 0 otherwise.
+func scheduleMessage(buffer singu.IQueue, msg *singu.QueueMessage, sched *writeScheduler, start func(job *writeJob)) int {
+	job := newWriteJob(buffer, msg)
+	if job == nil {
+		return 0
+	}
+	if !sched.add(job, writerConcurrency(sched, job.cat)) {
+		// put the message back so that other categories can proceed
+		if _, err := buffer.Requeue(msg.Id, true); err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error requeueing message %s/%s: %e", msg.Id, string(msg.Payload), err))
+		}
+		return 1
+	}
+	sched.dispatch(start)
+	return 0
+}
+
+// newWriteJob decodes a message taken from buffer. Returns nil if the message is done with (undecodable) or not due
+// for writing yet (waiting for its next attempt).
+func newWriteJob(buffer singu.IQueue, msg *singu.QueueMessage) *writeJob {
+	entry, err := logger.UnmarshalLogEntry(msg.Payload)
+	if err != nil {
+		log.Printf(fmt.Sprintf("ERROR: error decoding message %s/%s, discarded: %e", msg.Id, string(msg.Payload), err))
+		metricLogDiscarded.WithLabelValues("").Inc()
+		if err := buffer.Finish(msg.Id); err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error finishing message %s/%s: %e", msg.Id, string(msg.Payload), err))
+		}
+		return nil
+	}
+	if entry.Received.IsZero() {
+		// legacy payload queued before log entry model was introduced
+		entry.Received = msg.Timestamp
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = entry.Received
+	}
+	if entry.NextAttempt.After(time.Now()) {
+		// too early to retry, wait in ephemeral storage until the next attempt
+		delayRetry(buffer, msg.Id, entry.NextAttempt)
+		return nil
+	}
+	cat, lwi := getLogWriter(entry.Category)
+	if probeAt := openCircuitRetry(lwi, msg); !probeAt.IsZero() {
+		// circuit breaker is open: wait for the next probe without taking a write slot
+		delayRetry(buffer, msg.Id, probeAt)
+		return nil
+	}
+	return &writeJob{msg: msg, entry: entry, cat: cat}
+}
+
+// isCircuitOpen returns true if the circuit breaker of the log writer handling a category currently rejects writes
+func isCircuitOpen(cat string) bool {
+	_, lwi := getLogWriter(cat)
+	return lwi != nil && !lwi.Breaker.RejectUntil().IsZero()
+}
+
+// openCircuitRetry returns the time a message is to be retried if the circuit breaker of its log writer currently rejects
+// writes, which is the next probe or the message's retry deadline, whichever comes first. Returns zero time if the breaker
+// allows writes, or the message has passed its retry deadline (it is dead-lettered by writeLogMessage).
+func openCircuitRetry(lwi *logger.LogWriterAndInfo, msg *singu.QueueMessage) time.Time {
+	if lwi == nil {
+		return time.Time{}
+	}
+	probeAt := lwi.Breaker.RejectUntil()
+	if probeAt.IsZero() || lwi.RetrySeconds < 0 {
+		return probeAt
+	}
+	deadline := msg.Timestamp.Add(time.Duration(lwi.RetrySeconds) * time.Second)
+	if !time.Now().Before(deadline) {
+		return time.Time{}
+	}
+	if probeAt.After(deadline) {
+		return deadline
+	}
+	return probeAt
+}
+
+// writeLogMessage writes a log entry taken from buffer, then finishes the message or puts it back to buffer for retrying
+func writeLogMessage(buffer singu.IQueue, msg *singu.QueueMessage, entry *logger.LogEntry, counterSuccess *int64) {
+	var finish = true
+	var retryEntry *logger.LogEntry
+	cat, lwi := acquireLogWriter(entry.Category)
+	allowed, probeAt := true, time.Time{}
+	if lwi != nil {
+		defer lwi.InFlight.Done()
+		allowed, probeAt = lwi.Breaker.Allow()
+	}
+	if lwi == nil {
+		log.Printf(fmt.Sprintf("WARN: no log writer found for category [%s]", entry.Category))
+		metricLogDiscarded.WithLabelValues(cat).Inc()
+		putDeadLetter(cat, msg.Id, entry, errNoLogWriter, entry.Attempts, msg.Timestamp)
+	} else if !allowed {
+		// circuit breaker is open: the entry is deferred until the next probe without calling the log writer
+		deadline := msg.Timestamp.Add(time.Duration(lwi.RetrySeconds) * time.Second)
+		if lwi.RetrySeconds >= 0 && !time.Now().Before(deadline) {
+			metricLogDiscarded.WithLabelValues(cat).Inc()
+			putDeadLetter(cat, msg.Id, entry, errors.New("circuit breaker is open"), entry.Attempts, msg.Timestamp)
+		} else {
+			if lwi.RetrySeconds >= 0 && probeAt.After(deadline) {
+				probeAt = deadline
+			}
+			delayRetry(buffer, msg.Id, probeAt)
+			return
+		}
+	} else if err := writeLogEntry(cat, lwi, entry); err != nil {
+		log.Printf(fmt.Sprintf("ERROR: error writing log to [%s]: %e", entry.Category, err))
+		recordWrite(cat, err)
+		metricLogFailed.WithLabelValues(cat).Inc()
+		entry.Attempts++
+		deadline := msg.Timestamp.Add(time.Duration(lwi.RetrySeconds) * time.Second)
+		if now := time.Now(); lwi.RetrySeconds < 0 || now.Before(deadline) {
+			// set finish=false to requeue if message has not been queued for 'RetrySeconds'
+			finish, retryEntry = false, entry
+			entry.NextAttempt = now.Add(lwi.RetryBackoff.Delay(entry.Attempts))
+			if lwi.RetrySeconds >= 0 && entry.NextAttempt.After(deadline) {
+				// the last attempt is made at the deadline
+				entry.NextAttempt = deadline
 			}
+			metricLogRetried.WithLabelValues(cat).Inc()
+		} else {
+			metricLogDiscarded.WithLabelValues(cat).Inc()
+			putDeadLetter(cat, msg.Id, entry, err, entry.Attempts, msg.Timestamp)
+		}
+	} else {
+		atomic.AddInt64(counterSuccess, 1)
+		metricLogWritten.WithLabelValues(cat).Inc()
+		recordWrite(cat, nil)
+	}
+	if isBufferClosed() {
+		// shutdown timed out before write completed, message is processed again on next start
+		return
+	}
+	if finish {
+		if err := buffer.Finish(msg.Id); err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error finishing message %s/%s: %e", msg.Id, string(msg.Payload), err))
+		}
+	} else if err := requeueForRetry(buffer, msg, retryEntry); err != nil {
+		log.Printf(fmt.Sprintf("ERROR: error requeueing message %s/%s: %e", msg.Id, string(msg.Payload), err))
+	}
+}
+
+// writeLogEntry writes a log entry using a log writer, recording write latency and result of the write to the writer's
+// circuit breaker
+func writeLogEntry(cat string, lwi *logger.LogWriterAndInfo, entry *logger.LogEntry) error {
+	defer observeWriteDuration(lwi.Type, time.Now())
+	err := lwi.LogWriter.Write(entry)
+	if lwi.Breaker.Record(err) {
+		state := lwi.Breaker.State()
+		if state == logger.BreakerOpen {
+			log.Printf(fmt.Sprintf("WARN: circuit breaker of log writer [%s] is open, writes are paused for %s", cat, lwi.Breaker.OpenDuration))
+		} else {
+			log.Printf(fmt.Sprintf("INFO: circuit breaker of log writer [%s] is %s", cat, state))
 		}
-		return result
+		setBreakerState(cat, state)
 	}
-	return nil
+	return err
 }
 
-// convenient function to handle incoming message
-// payload format: <category-name><tab-character><log-message>
-func handleIncomingMessage(payload []byte, throttling bool) error {
+func initLogWriters(config *configuration.Config) map[string]*logger.LogWriterAndInfo {
+	confs, err := logWriterConfigs(config)
+	if err != nil {
+		panic(err)
+	}
+	result := make(map[string]*logger.LogWriterAndInfo)
+	for cat, conf := range confs {
+		if writer, err := logger.NewLogWriter(cat, conf, handleIncomingMessage); err != nil {
+			panic(err)
+		} else {
+			result[cat] = newLogWriterAndInfo(writer, conf)
+		}
+	}
+	logWriterConfs = confs
+	return result
+}
+
+// defaultMaxMessageSize is the max size of a message received via UDP, TCP or syslog gateways if [server.max_request_size] is not configured
+const defaultMaxMessageSize = 4096
+
+// maxMessageSize returns max size of a message received via UDP, TCP or syslog gateways ([server.max_request_size])
+func maxMessageSize() int {
+	if bodyLimit := AppConfig.GetByteSize("server.max_request_size"); bodyLimit != nil && bodyLimit.Int64() > 0 {
+		return int(bodyLimit.Int64())
+	}
+	return defaultMaxMessageSize
+}
+
+const (
+	gatewayHttp   = "http"
+	gatewayGrpc   = "grpc"
+	gatewayUdp    = "udp"
+	gatewayTcp    = "tcp"
+	gatewaySyslog = "syslog"
+)
+
+// newLogEntry creates a new log entry received via a gateway
+func newLogEntry(category, message, gateway, source string) *logger.LogEntry {
+	entry := logger.NewLogEntry(strings.ToLower(category), message)
+	entry.Gateway = gateway
+	entry.Source = source
+	return entry
+}
+
+// parseTsvMessage parses a log message in format [<timestamp><tab-character>]<category-name><tab-character><log-message>
+//	- timestamp is optional and must be in RFC3339 format, zero time is returned if timestamp is not supplied
+//	- log message can contain tab characters
+func parseTsvMessage(payload string) (timestamp time.Time, category, message string, ok bool) {
+	tokens := strings.SplitN(payload, logger.SeparatorTsv, 3)
+	if len(tokens) == 3 {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(tokens[0])); err == nil {
+			timestamp = t
+			tokens = tokens[1:]
+		} else {
+			tokens = []string{tokens[0], tokens[1] + logger.SeparatorTsv + tokens[2]}
+		}
+	}
+	if len(tokens) != 2 {
+		return timestamp, "", "", false
+	}
+	category, message = strings.TrimSpace(tokens[0]), strings.TrimSpace(tokens[1])
+	return timestamp, category, message, category != "" && message != ""
+}
+
+// parseTimestamp parses a client-supplied timestamp, which is either a string in RFC3339 format or a number of milliseconds since UNIX epoch
+func parseTimestamp(v interface{}) (time.Time, error) {
+	switch v.(type) {
+	case float64:
+		return time.Unix(0, int64(v.(float64)*float64(time.Millisecond))), nil
+	case string:
+		str := strings.TrimSpace(v.(string))
+		if ms, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond)), nil
+		}
+		return time.Parse(time.RFC3339, str)
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("invalid timestamp: %v", v))
+}
+
+// convenient function to handle incoming log entry
+func handleIncomingMessage(entry *logger.LogEntry, throttling bool) error {
 	if throttling {
 		// increase concurrency count to throttle [buffer->log-writer] rate
 		atomic.AddInt64(&ConcurrentWrite, 1)
 		defer atomic.AddInt64(&ConcurrentWrite, -1)
 	}
 
-	_, err := Buffer.Queue(singu.NewQueueMessage(payload))
+	if entry.Received.IsZero() {
+		entry.Received = time.Now()
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = entry.Received
+	}
+	// entries (e.g. replayed dead letters or fanned out entries) start with a clean retry state
+	entry.Attempts, entry.NextAttempt = 0, time.Time{}
+	var err error
+	payload := entry.Marshal()
+	if isBufferClosed() {
+		err = errShuttingDown
+	} else if _, lwi := getLogWriter(entry.Category); throttling && isSyncDelivery(entry, lwi) {
+		// entries of categories with delivery=sync are acknowledged only after being written
+		err = writeSync(entry)
+	} else {
+		if bb, ok := Buffer.(*boundedBuffer); ok {
+			err = bb.offer(entry, payload)
+		} else {
+			_, err = Buffer.Queue(singu.NewQueueMessage(payload))
+		}
+		if err == singu.ErrorQueueIsFull {
+			// capacity of the buffer backend itself is reached
+			err = errBufferFull
+		} else if err != errBufferFull {
+			recordBufferQueue(err)
+		}
+	}
+	if throttling {
+		// entries from gateways are put to buffer with throttling, entries from fanout writers are not counted again
+		if err != nil {
+			countGatewayRejected(entry.Gateway)
+			if err == errBufferFull {
+				metricBufferRejected.WithLabelValues(entry.Gateway).Inc()
+			}
+		} else {
+			metricGatewayReceived.WithLabelValues(entry.Gateway).Inc()
+		}
+	}
 	return err
 }
@@ -0,0 +1,80 @@
+package prista
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTsvMessage(t *testing.T) {
+	testCases := []struct {
+		name      string
+		payload   string
+		timestamp time.Time
+		category  string
+		message   string
+		ok        bool
+	}{
+		{"category and message", "default\tmy log message", time.Time{}, "default", "my log message", true},
+		{"message with tabs", "default\tcolumn 1\tcolumn 2", time.Time{}, "default", "column 1\tcolumn 2", true},
+		{"timestamp", "2020-02-08T13:14:15+07:00\tdefault\tmy log message",
+			time.Date(2020, 2, 8, 6, 14, 15, 0, time.UTC), "default", "my log message", true},
+		{"timestamp and message with tabs", "2020-02-08T13:14:15Z\tdefault\tcolumn 1\tcolumn 2",
+			time.Date(2020, 2, 8, 13, 14, 15, 0, time.UTC), "default", "column 1\tcolumn 2", true},
+		{"fractional seconds", "2020-02-08T13:14:15.678Z\tdefault\tmsg",
+			time.Date(2020, 2, 8, 13, 14, 15, 678000000, time.UTC), "default", "msg", true},
+		{"surrounding spaces are trimmed", " default \t my log message \n", time.Time{}, "default", "my log message", true},
+		{"invalid timestamp is part of category", "yesterday\tdefault\tmsg", time.Time{}, "yesterday", "default\tmsg", true},
+		{"no tab", "default my log message", time.Time{}, "", "", false},
+		{"empty category", "\tmy log message", time.Time{}, "", "", false},
+		{"empty message", "default\t ", time.Time{}, "", "", false},
+		{"timestamp without message", "2020-02-08T13:14:15Z\tdefault\t", time.Date(2020, 2, 8, 13, 14, 15, 0, time.UTC), "", "", false},
+		{"empty", "", time.Time{}, "", "", false},
+	}
+	for _, tc := range testCases {
+		timestamp, category, message, ok := parseTsvMessage(tc.payload)
+		if ok != tc.ok {
+			t.Errorf("%s: expected ok=%v but received %v", tc.name, tc.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !timestamp.Equal(tc.timestamp) || category != tc.category || message != tc.message {
+			t.Errorf("%s: expected (%s, %q, %q) but received (%s, %q, %q)", tc.name, tc.timestamp, tc.category, tc.message, timestamp, category, message)
+		}
+	}
+}
+
+func TestCategoryDirName(t *testing.T) {
+	testCases := []struct {
+		category string
+		dirName  string
+	}{
+		{"default", "default"},
+		{"web-app_1.access", "web-app_1.access"},
+		{"a/b", "a%2Fb"},
+		{"a:b", "a%3Ab"},
+		{"a_b", "a_b"},
+		{"a%2Fb", "a%252Fb"},
+		{".", "%2E"},
+		{"..", "%2E."},
+		{".hidden", "%2Ehidden"},
+		{"a\\..\\b", "a%5C..%5Cb"},
+		{"người dùng", "ng%C6%B0%E1%BB%9Di%20d%C3%B9ng"},
+	}
+	for _, tc := range testCases {
+		dirName := categoryDirName(tc.category)
+		if dirName != tc.dirName {
+			t.Errorf("category %q: expected directory %q but received %q", tc.category, tc.dirName, dirName)
+		}
+		if category, ok := categoryFromDirName(dirName); !ok || category != tc.category {
+			t.Errorf("directory %q: expected category %q but received %q (%v)", dirName, tc.category, category, ok)
+		}
+	}
+	// directories not named by categoryDirName are not taken as categories
+	for _, dirName := range []string{"", "a%2fb", "a/b", "%zz", ".hidden"} {
+		if category, ok := categoryFromDirName(dirName); ok {
+			t.Errorf("directory %q: expected invalid but received category %q", dirName, category)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package prista
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btnguyen2k/consu/reddo"
+	"github.com/go-akka/configuration"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"main/src/logger"
+	"main/src/utils"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultApiKeyHeader = "X-API-Key"
+
+	udpAuthKey  = "key"  // UDP datagrams and TCP lines are prefixed with the API key
+	udpAuthHmac = "hmac" // UDP datagrams and TCP lines are prefixed with the key name, a timestamp and HMAC-SHA256 of the timestamp and the rest of the message
+
+	defaultReplayWindow = 60 * time.Second
+
+	authAccepted        = "accepted"
+	authUnauthenticated = "unauthenticated"
+	authForbidden       = "forbidden"
+)
+
+var (
+	errUnauthenticated = errors.New("missing or invalid API key")
+	errForbidden       = errors.New("API key is not allowed to write to the category")
+	errAdminForbidden  = errors.New("API key is not allowed to access admin API")
+	errAdminRemote     = errors.New("admin API is only accessible from loopback addresses when authentication is disabled")
+	errReplayed        = errors.New("message is expired or replayed")
+)
+
+// apiKey is a key clients authenticate with, allowed to write to categories matching its patterns
+type apiKey struct {
+	name       string   // name of the key, used in metrics and logs (the key itself is never logged)
+	key        string   // the key
+	categories []string // glob patterns (lower case) of categories the key is allowed to write to
+	admin      bool     // true if the key is allowed to access admin API
+}
+
+// apiKeyAuth authenticates clients of HTTP, gRPC, UDP and TCP gateways by API keys, configured at [server.auth]
+type apiKeyAuth struct {
+	header  string // HTTP header (or gRPC metadata, in lower case) carrying the API key
+	udpMode string // how UDP datagrams and TCP lines are authenticated: "key" or "hmac"
+	keys    []*apiKey
+	replays *replayGuard // rejects replayed messages in "hmac" mode
+}
+
+// replayGuard rejects signed messages whose timestamp is out of the replay window, or whose signature has been seen
+// within the window
+type replayGuard struct {
+	window   time.Duration
+	lock     sync.Mutex
+	seen     map[string]time.Time // signatures of accepted messages, mapped to the time they fall out of the window
+	prunedAt time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{window: window, seen: make(map[string]time.Time)}
+}
+
+// check returns true if a message signed at signedAt is within the window from now and its signature has not been
+// seen, and remembers the signature until the message falls out of the window
+func (g *replayGuard) check(signature string, signedAt, now time.Time) bool {
+	if signedAt.Before(now.Add(-g.window)) || signedAt.After(now.Add(g.window)) {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if now.Sub(g.prunedAt) >= g.window {
+		for sig, expiry := range g.seen {
+			if !now.Before(expiry) {
+				delete(g.seen, sig)
+			}
+		}
+		g.prunedAt = now
+	}
+	if expiry, ok := g.seen[signature]; ok && now.Before(expiry) {
+		return false
+	}
+	g.seen[signature] = signedAt.Add(g.window)
+	return true
+}
+
+// Auth is nil if API-key authentication is disabled
+var Auth *apiKeyAuth
+
+// initAuth loads API keys from config block [server.auth], returns nil if authentication is disabled
+func initAuth(config *configuration.Config) *apiKeyAuth {
+	if !config.GetBoolean("server.auth.enabled", false) {
+		return nil
+	}
+	auth := &apiKeyAuth{
+		header:  strings.TrimSpace(config.GetString("server.auth.header", defaultApiKeyHeader)),
+		udpMode: strings.ToLower(strings.TrimSpace(config.GetString("server.auth.udp_mode", udpAuthHmac))),
+	}
+	if auth.header == "" {
+		auth.header = defaultApiKeyHeader
+	}
+	if auth.udpMode != udpAuthKey && auth.udpMode != udpAuthHmac {
+		panic(fmt.Sprintf("invalid [server.auth.udp_mode]: %s", auth.udpMode))
+	}
+	replayWindow := config.GetTimeDuration("server.auth.replay_window", defaultReplayWindow)
+	if replayWindow <= 0 {
+		panic(fmt.Sprintf("invalid [server.auth.replay_window]: %s", replayWindow))
+	}
+	auth.replays = newReplayGuard(replayWindow)
+	var err error
+	if keysConf := config.GetValue("server.auth.keys"); keysConf != nil && !keysConf.IsEmpty() {
+		if auth.keys, err = parseApiKeys(utils.UnwrapHocon(keysConf)); err != nil {
+			panic(err)
+		}
+	}
+	if len(auth.keys) == 0 {
+		panic("API-key authentication is enabled but no key is configured at [server.auth.keys]")
+	}
+	return auth
+}
+
+// parseApiKeys parses API keys from config, which is a list of objects {name=..., key=..., categories=[...], admin=true|false}
+func parseApiKeys(conf interface{}) ([]*apiKey, error) {
+	list, ok := conf.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("invalid API keys, expecting a list but received %T", conf))
+	}
+	keys := make([]*apiKey, 0, len(list))
+	names := make(map[string]bool)
+	for i, item := range list {
+		if item == nil {
+			// empty list
+			continue
+		}
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid API key #%d, expecting an object but received %T", i, item))
+		}
+		key := &apiKey{categories: make([]string, 0)}
+		for k, v := range m {
+			switch k {
+			case "name":
+				key.name = strings.TrimSpace(fmt.Sprintf("%v", v))
+			case "key":
+				key.key = strings.TrimSpace(fmt.Sprintf("%v", v))
+			case "categories":
+				patterns, ok := v.([]interface{})
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("invalid API key #%d: [categories] must be a list of patterns", i))
+				}
+				for _, p := range patterns {
+					pattern := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", p)))
+					if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+						return nil, errors.New(fmt.Sprintf("invalid API key #%d: invalid pattern [%s]", i, pattern))
+					}
+					key.categories = append(key.categories, pattern)
+				}
+			case "admin":
+				admin, err := reddo.ToBool(v)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("invalid API key #%d: invalid [admin]: %s", i, err))
+				}
+				key.admin = admin
+			default:
+				return nil, errors.New(fmt.Sprintf("invalid API key #%d: unknown key [%s]", i, k))
+			}
+		}
+		if key.name == "" || key.key == "" {
+			return nil, errors.New(fmt.Sprintf("invalid API key #%d: both [name] and [key] must be configured", i))
+		}
+		if names[key.name] {
+			return nil, errors.New(fmt.Sprintf("invalid API key #%d: duplicated name [%s]", i, key.name))
+		}
+		names[key.name] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// authenticate returns the API key matching a key supplied by a client, or nil if no key matches
+func (auth *apiKeyAuth) authenticate(key string) *apiKey {
+	var result *apiKey
+	for _, k := range auth.keys {
+		// compare with all keys in constant time, so that response time does not tell how much of a key is correct
+		if subtle.ConstantTimeCompare([]byte(k.key), []byte(key)) == 1 {
+			result = k
+		}
+	}
+	return result
+}
+
+// keyByName returns the API key of a name, or nil if not found
+func (auth *apiKeyAuth) keyByName(name string) *apiKey {
+	for _, k := range auth.keys {
+		if k.name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// allows returns true if the key is allowed to write to a category
+func (k *apiKey) allows(category string) bool {
+	category = strings.ToLower(category)
+	for _, pattern := range k.categories {
+		if ok, _ := path.Match(pattern, category); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateMessage authenticates a message that carries its own credentials (an UDP datagram or a line of the TCP
+// gateway) and returns the API key and the rest of the message, which is either
+//	- <api-key><tab-character><payload> (udp_mode "key")
+//	- <key-name>:<timestamp>:<signature><tab-character><payload> (udp_mode "hmac"), where timestamp is UNIX time in
+//	  milliseconds and signature is hex-encoded HMAC-SHA256 of <timestamp><tab-character><payload>, using the API key as
+//	  secret. Messages signed outside of [server.auth.replay_window] from now, or with a signature already accepted, are
+//	  rejected.
+func (auth *apiKeyAuth) authenticateMessage(message string) (*apiKey, string, error) {
+	tokens := strings.SplitN(message, logger.SeparatorTsv, 2)
+	if len(tokens) != 2 {
+		return nil, message, errUnauthenticated
+	}
+	credentials, payload := tokens[0], tokens[1]
+	if auth.udpMode == udpAuthKey {
+		if key := auth.authenticate(credentials); key != nil {
+			return key, payload, nil
+		}
+		return nil, payload, errUnauthenticated
+	}
+	tokens = strings.SplitN(credentials, ":", 3)
+	if len(tokens) != 3 {
+		return nil, payload, errUnauthenticated
+	}
+	key := auth.keyByName(tokens[0])
+	timestamp, errTimestamp := strconv.ParseInt(tokens[1], 10, 64)
+	signature, err := hex.DecodeString(tokens[2])
+	if key == nil || errTimestamp != nil || err != nil {
+		return nil, payload, errUnauthenticated
+	}
+	mac := hmac.New(sha256.New, []byte(key.key))
+	mac.Write([]byte(tokens[1] + logger.SeparatorTsv + payload))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, payload, errUnauthenticated
+	}
+	signedAt := time.Unix(0, timestamp*int64(time.Millisecond))
+	if !auth.replays.check(key.name+":"+strings.ToLower(tokens[2]), signedAt, time.Now()) {
+		return nil, payload, errReplayed
+	}
+	return key, payload, nil
+}
+
+// authorize checks if a log entry is allowed to be written by the API key it was sent with, counting the result to
+// per-key metrics. key is nil if the client failed to authenticate. Always succeeds if authentication is disabled.
+func authorize(key *apiKey, entry *logger.LogEntry) error {
+	if Auth == nil {
+		return nil
+	}
+	if key == nil {
+		countAuth("", authUnauthenticated)
+		countGatewayRejected(entry.Gateway)
+		return errUnauthenticated
+	}
+	if !key.allows(entry.Category) {
+		countAuth(key.name, authForbidden)
+		countGatewayRejected(entry.Gateway)
+		return errForbidden
+	}
+	countAuth(key.name, authAccepted)
+	return nil
+}
+
+// requestApiKey returns the API key supplied by a client, either in the API-key header/metadata or as a bearer token
+func requestApiKey(key, authorization string) string {
+	if key = strings.TrimSpace(key); key != "" {
+		return key
+	}
+	if authorization = strings.TrimSpace(authorization); len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+const httpCtxApiKey = "apiKey"
+
+// httpAuthenticate is a middleware that rejects requests without a valid API key with "401 Unauthorized", and keeps the
+// API key in request context (see httpApiKey) to authorize log entries of the request
+func httpAuthenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if Auth == nil {
+			return next(c)
+		}
+		req := c.Request()
+		key := Auth.authenticate(requestApiKey(req.Header.Get(Auth.header), req.Header.Get(echo.HeaderAuthorization)))
+		if key == nil {
+			countAuth("", authUnauthenticated)
+			countGatewayRejected(gatewayHttp)
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return c.HTML(http.StatusUnauthorized, errUnauthenticated.Error())
+		}
+		c.Set(httpCtxApiKey, key)
+		return next(c)
+	}
+}
+
+// httpAuthenticateAdmin is a middleware protecting admin API: requests must be sent with an API key allowed to access
+// admin API ("admin = true"), or from a loopback address if API-key authentication is disabled
+func httpAuthenticateAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if Auth == nil {
+			// client address of the connection, headers such as X-Forwarded-For can be forged
+			host, _, _ := net.SplitHostPort(req.RemoteAddr)
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				return c.HTML(http.StatusForbidden, errAdminRemote.Error())
+			}
+			return next(c)
+		}
+		key := Auth.authenticate(requestApiKey(req.Header.Get(Auth.header), req.Header.Get(echo.HeaderAuthorization)))
+		if key == nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return c.HTML(http.StatusUnauthorized, errUnauthenticated.Error())
+		}
+		if !key.admin {
+			return c.HTML(http.StatusForbidden, errAdminForbidden.Error())
+		}
+		return next(c)
+	}
+}
+
+// httpApiKey returns the API key the request was authenticated with (nil if authentication is disabled)
+func httpApiKey(c echo.Context) *apiKey {
+	key, _ := c.Get(httpCtxApiKey).(*apiKey)
+	return key
+}
+
+// grpcApiKey authenticates a gRPC call by the API key supplied in metadata, returns nil if authentication is disabled
+func grpcApiKey(ctx context.Context) (*apiKey, error) {
+	if Auth == nil {
+		return nil, nil
+	}
+	var key, authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(strings.ToLower(Auth.header)); len(v) > 0 {
+			key = v[0]
+		}
+		if v := md.Get("authorization"); len(v) > 0 {
+			authorization = v[0]
+		}
+	}
+	if result := Auth.authenticate(requestApiKey(key, authorization)); result != nil {
+		return result, nil
+	}
+	countAuth("", authUnauthenticated)
+	countGatewayRejected(gatewayGrpc)
+	return nil, status.Error(codes.Unauthenticated, errUnauthenticated.Error())
+}
@@ -0,0 +1,228 @@
+package prista
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-akka/configuration"
+	"main/src/utils"
+	"testing"
+	"time"
+)
+
+func newTestAuth(t *testing.T, udpMode string) *apiKeyAuth {
+	conf := configuration.ParseString(fmt.Sprintf(`server.auth {
+  enabled = true
+  udp_mode = %s
+  keys = [
+    { name = "webapp", key = "webapp-key", categories = ["webapp", "webapp-*"] }
+    { name = "ops", key = "ops-key", admin = true }
+  ]
+}`, udpMode))
+	auth := initAuth(conf)
+	if auth == nil {
+		t.Fatalf("expected authentication to be enabled")
+	}
+	return auth
+}
+
+// signMessage prefixes a payload with credentials of udp_mode "hmac"
+func signMessage(name, key string, signedAt time.Time, payload string) string {
+	ts := fmt.Sprintf("%d", signedAt.UnixNano()/int64(time.Millisecond))
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(ts + "\t" + payload))
+	return fmt.Sprintf("%s:%s:%s\t%s", name, ts, hex.EncodeToString(mac.Sum(nil)), payload)
+}
+
+func TestParseApiKeys(t *testing.T) {
+	testCases := []struct {
+		name  string
+		conf  string
+		keys  []string // names of admin keys are suffixed with "*"
+		valid bool
+	}{
+		{"keys", `keys = [{ name = a, key = k1, categories = ["x"] }, { name = b, key = k2, admin = true }]`, []string{"a", "b*"}, true},
+		{"empty list", `keys = []`, []string{}, true},
+		{"missing key", `keys = [{ name = a }]`, nil, false},
+		{"missing name", `keys = [{ key = k1 }]`, nil, false},
+		{"duplicated name", `keys = [{ name = a, key = k1 }, { name = a, key = k2 }]`, nil, false},
+		{"unknown setting", `keys = [{ name = a, key = k1, roles = ["x"] }]`, nil, false},
+		{"invalid pattern", `keys = [{ name = a, key = k1, categories = ["[x"] }]`, nil, false},
+		{"invalid admin", `keys = [{ name = a, key = k1, admin = maybe }]`, nil, false},
+		{"not a list", `keys = { name = a, key = k1 }`, nil, false},
+	}
+	for _, tc := range testCases {
+		keys, err := parseApiKeys(utils.UnwrapHocon(configuration.ParseString(tc.conf).GetValue("keys")))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%v but received error %v", tc.name, tc.valid, err)
+			continue
+		}
+		if !tc.valid {
+			continue
+		}
+		names := make([]string, 0, len(keys))
+		for _, k := range keys {
+			if k.admin {
+				names = append(names, k.name+"*")
+			} else {
+				names = append(names, k.name)
+			}
+		}
+		if fmt.Sprintf("%v", names) != fmt.Sprintf("%v", tc.keys) {
+			t.Errorf("%s: expected keys %v but received %v", tc.name, tc.keys, names)
+		}
+	}
+}
+
+func TestApiKeyAllows(t *testing.T) {
+	key := &apiKey{name: "webapp", categories: []string{"webapp", "webapp-*"}}
+	testCases := []struct {
+		category string
+		allowed  bool
+	}{
+		{"webapp", true},
+		{"WebApp", true},
+		{"webapp-access", true},
+		{"webapp2", false},
+		{"audit", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		if allowed := key.allows(tc.category); allowed != tc.allowed {
+			t.Errorf("category [%s]: expected allowed=%v but received %v", tc.category, tc.allowed, allowed)
+		}
+	}
+}
+
+func TestRequestApiKey(t *testing.T) {
+	testCases := []struct {
+		key           string
+		authorization string
+		expected      string
+	}{
+		{"my-key", "", "my-key"},
+		{" my-key ", "Bearer other-key", "my-key"},
+		{"", "Bearer my-key", "my-key"},
+		{"", "bearer  my-key ", "my-key"},
+		{"", "Basic dXNlcjpwYXNz", ""},
+		{"", "Bearer ", ""},
+		{"", "", ""},
+	}
+	for _, tc := range testCases {
+		if key := requestApiKey(tc.key, tc.authorization); key != tc.expected {
+			t.Errorf("(%q, %q): expected %q but received %q", tc.key, tc.authorization, tc.expected, key)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := newTestAuth(t, udpAuthKey)
+	testCases := []struct {
+		key      string
+		expected string // name of the matched key, empty if none
+	}{
+		{"webapp-key", "webapp"},
+		{"ops-key", "ops"},
+		{"webapp-key ", ""},
+		{"webapp", ""},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		name := ""
+		if key := auth.authenticate(tc.key); key != nil {
+			name = key.name
+		}
+		if name != tc.expected {
+			t.Errorf("key %q: expected %q but received %q", tc.key, tc.expected, name)
+		}
+	}
+}
+
+func TestAuthenticateMessageKey(t *testing.T) {
+	auth := newTestAuth(t, udpAuthKey)
+	testCases := []struct {
+		name    string
+		message string
+		key     string // name of the authenticated key
+		payload string
+		err     error
+	}{
+		{"valid", "webapp-key\twebapp\tmy log message", "webapp", "webapp\tmy log message", nil},
+		{"valid replayed", "webapp-key\twebapp\tmy log message", "webapp", "webapp\tmy log message", nil},
+		{"invalid key", "wrong-key\twebapp\tmy log message", "", "webapp\tmy log message", errUnauthenticated},
+		{"no credentials", "webapp my log message", "", "", errUnauthenticated},
+	}
+	for _, tc := range testCases {
+		key, payload, err := auth.authenticateMessage(tc.message)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v but received %v", tc.name, tc.err, err)
+			continue
+		}
+		if err == nil && (key.name != tc.key || payload != tc.payload) {
+			t.Errorf("%s: expected (%s, %q) but received (%s, %q)", tc.name, tc.key, tc.payload, key.name, payload)
+		}
+	}
+}
+
+func TestAuthenticateMessageHmac(t *testing.T) {
+	auth := newTestAuth(t, udpAuthHmac)
+	now := time.Now()
+	signed := signMessage("webapp", "webapp-key", now, "webapp\tmy log message")
+	testCases := []struct {
+		name    string
+		message string
+		key     string // name of the authenticated key
+		err     error
+	}{
+		{"valid", signed, "webapp", nil},
+		{"replayed", signed, "", errReplayed},
+		{"same payload, other timestamp", signMessage("webapp", "webapp-key", now.Add(time.Millisecond), "webapp\tmy log message"), "webapp", nil},
+		{"slightly in the future", signMessage("ops", "ops-key", now.Add(30*time.Second), "audit\tmsg"), "ops", nil},
+		{"expired", signMessage("webapp", "webapp-key", now.Add(-2*defaultReplayWindow), "webapp\tmsg"), "", errReplayed},
+		{"too far in the future", signMessage("webapp", "webapp-key", now.Add(2*defaultReplayWindow), "webapp\tmsg"), "", errReplayed},
+		{"wrong secret", signMessage("webapp", "ops-key", now, "webapp\tmsg"), "", errUnauthenticated},
+		{"unknown key", signMessage("nobody", "webapp-key", now, "webapp\tmsg"), "", errUnauthenticated},
+		{"tampered payload", signMessage("webapp", "webapp-key", now, "webapp\tmsg") + "!", "", errUnauthenticated},
+		{"signature without timestamp", "webapp:" + signed[len("webapp:")+14:], "", errUnauthenticated},
+		{"invalid timestamp", "webapp:yesterday:00\twebapp\tmsg", "", errUnauthenticated},
+		{"invalid signature", "webapp:1:zz\twebapp\tmsg", "", errUnauthenticated},
+		{"no credentials", "webapp my log message", "", errUnauthenticated},
+	}
+	for _, tc := range testCases {
+		key, _, err := auth.authenticateMessage(tc.message)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v but received %v", tc.name, tc.err, err)
+			continue
+		}
+		if err == nil && key.name != tc.key {
+			t.Errorf("%s: expected key %s but received %s", tc.name, tc.key, key.name)
+		}
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Now()
+	g := newReplayGuard(time.Minute)
+	testCases := []struct {
+		name      string
+		signature string
+		signedAt  time.Time
+		now       time.Time
+		accepted  bool
+	}{
+		{"fresh", "a", now, now, true},
+		{"replayed", "a", now, now.Add(30 * time.Second), false},
+		{"other signature", "b", now, now, true},
+		{"out of window", "c", now, now.Add(2 * time.Minute), false},
+		{"seen signature pruned after window", "a", now.Add(2 * time.Minute), now.Add(2 * time.Minute), true},
+	}
+	for _, tc := range testCases {
+		if accepted := g.check(tc.signature, tc.signedAt, tc.now); accepted != tc.accepted {
+			t.Errorf("%s: expected accepted=%v but received %v", tc.name, tc.accepted, accepted)
+		}
+	}
+	if len(g.seen) != 1 {
+		t.Errorf("expected expired signatures to be pruned but %d are kept", len(g.seen))
+	}
+}
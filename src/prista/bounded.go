@@ -0,0 +1,408 @@
+package prista
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btnguyen2k/singu"
+	"github.com/go-akka/configuration"
+	"io/ioutil"
+	"log"
+	"main/src/logger"
+	"main/src/utils"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	overflowReject       = "reject"               // incoming log entries are rejected when buffer is full
+	overflowDropOldest   = "drop_oldest"          // oldest buffered log entries are dropped to make room for incoming ones
+	overflowDropCategory = "drop_category_oldest" // oldest buffered log entries of the incoming entry's category are dropped first, then of other categories
+	overflowDropPriority = "drop_priority"        // buffered log entries of lower priority categories are dropped to make room for incoming ones
+
+	defaultOverflowPolicy = overflowReject
+	defaultRetryAfter     = 5 * time.Second
+	maxDropsPerEntry      = 1000 // max number of buffered log entries dropped to make room for an incoming one
+
+	bufferUsageFile = "buffer-usage.json" // usage of persistent buffer saved on shutdown, stored under <temp_dir>
+)
+
+var (
+	errBufferFull    = errors.New("buffer is full, log entry rejected")
+	errShuttingDown  = errors.New("application is shutting down, log entry rejected")
+	errBufferDropped = errors.New("dropped: buffer is full")
+)
+
+// categoryQueues is implemented by buffers that keep a separate queue per category
+type categoryQueues interface {
+	// categories returns names of category queues, or nil if the buffer does not keep a separate queue per category
+	categories() []string
+	// takeFrom takes a message from queue of a category
+	takeFrom(cat string) (*singu.QueueMessage, error)
+	// removeIdle removes queue of a category if it is empty and no longer needed, returns true if removed
+	removeIdle(cat string) bool
+}
+
+// boundedBuffer keeps track of number and payload size of messages in buffer (waiting in queue or being written),
+// and limits them by [buffer.max_entries] and [buffer.max_bytes].
+type boundedBuffer struct {
+	singu.IQueue
+	maxEntries  int64         // 0 = no limit
+	maxBytes    int64         // 0 = no limit
+	policy      string        // what to do when buffer is full
+	retryAfter  time.Duration // suggested delay before clients retry rejected log entries
+	entries     int64         // number of messages in buffer, updated atomically
+	bytes       int64         // payload size of messages in buffer, updated atomically
+	full        int32         // 1 if the last incoming log entry did not fit in buffer
+	lock        sync.Mutex
+	taken       map[string]int64 // payload size of messages taken from buffer, keyed by message id
+	dropLock    sync.Mutex       // only one incoming log entry drops buffered ones at a time
+	reserveLock sync.Mutex       // room for incoming log entries is reserved one at a time
+	usageFile   string           // file to save usage to when the buffer is closed, empty if buffer is not persistent
+}
+
+// bufferCheckpoint is number and payload size of messages in buffer, saved when a persistent buffer is closed so that payload
+// size of messages still in buffer can be estimated on next start
+type bufferCheckpoint struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// loadBufferUsage counts messages persisted in buffer (waiting in queue or taken), and estimates their payload size by
+// the average payload size saved to usageFile when the buffer was last closed. The usage file is removed after being
+// read, so that it is not used again if the application does not shut down cleanly.
+func loadBufferUsage(queue singu.IQueue, usageFile string) (int64, int64, error) {
+	queueSize, err := queue.QueueSize()
+	if err != nil {
+		return 0, 0, err
+	}
+	ephemeralSize, err := queue.EphemeralSize()
+	if err != nil {
+		return 0, 0, err
+	}
+	var entries int64
+	for _, size := range []int{queueSize, ephemeralSize} {
+		if size > 0 {
+			entries += int64(size)
+		}
+	}
+	var usage bufferCheckpoint
+	data, err := ioutil.ReadFile(usageFile)
+	if err == nil {
+		err = json.Unmarshal(data, &usage)
+		if err := os.Remove(usageFile); err != nil {
+			log.Printf(fmt.Sprintf("WARN: error removing file [%s]: %e", usageFile, err))
+		}
+	}
+	if entries == 0 {
+		return 0, 0, nil
+	}
+	if err != nil || usage.Entries <= 0 {
+		log.Printf(fmt.Sprintf("WARN: payload size of %d entries in buffer is unknown (buffer was not closed cleanly), "+
+			"they are not counted towards buffer.max_bytes", entries))
+		return entries, 0, nil
+	}
+	return entries, entries * (usage.Bytes / usage.Entries), nil
+}
+
+func newBoundedBuffer(buffer singu.IQueue, config *configuration.Config, entries, bytes int64) (*boundedBuffer, error) {
+	b := &boundedBuffer{
+		IQueue:     buffer,
+		maxEntries: config.GetInt64("buffer.max_entries", 0),
+		policy:     strings.ToLower(strings.TrimSpace(config.GetString("buffer.overflow_policy", defaultOverflowPolicy))),
+		retryAfter: config.GetTimeDuration("buffer.retry_after", defaultRetryAfter),
+		entries:    entries,
+		bytes:      bytes,
+		taken:      make(map[string]int64),
+	}
+	if maxBytes := strings.TrimSpace(config.GetString("buffer.max_bytes", "")); maxBytes != "" {
+		var err error
+		if b.maxBytes, err = utils.ParseByteSize(maxBytes); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid [buffer.max_bytes] configuration: %s", err))
+		}
+	}
+	cq, perCategory := buffer.(categoryQueues)
+	perCategory = perCategory && cq.categories() != nil
+	switch b.policy {
+	case overflowReject:
+	case overflowDropOldest:
+		// per-category queues can not tell which of their buffered log entries is the oldest overall
+		if perCategory {
+			return nil, errors.New(fmt.Sprintf("overflow policy [%s] requires shared buffer (buffer.per_category=false), use [%s] with per-category buffer", b.policy, overflowDropCategory))
+		}
+	case overflowDropCategory, overflowDropPriority:
+		if !perCategory {
+			return nil, errors.New(fmt.Sprintf("overflow policy [%s] requires per-category buffer (buffer.per_category=true)", b.policy))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown overflow policy [%s]", b.policy))
+	}
+	if b.retryAfter < time.Second {
+		b.retryAfter = time.Second
+	}
+	return b, nil
+}
+
+// usage returns number and payload size of messages in buffer
+func (b *boundedBuffer) usage() (int64, int64) {
+	return atomic.LoadInt64(&b.entries), atomic.LoadInt64(&b.bytes)
+}
+
+// sizes returns number of messages waiting in buffer and number of messages taken from buffer (being written or waiting
+// for their next attempts), from the counters rather than scanning the underlying storage
+func (b *boundedBuffer) sizes() (int64, int64) {
+	b.lock.Lock()
+	taken := int64(len(b.taken))
+	b.lock.Unlock()
+	queued := atomic.LoadInt64(&b.entries) - taken
+	if queued < 0 {
+		queued = 0
+	}
+	return queued, taken
+}
+
+func (b *boundedBuffer) isFull() bool {
+	return atomic.LoadInt32(&b.full) == 1
+}
+
+func (b *boundedBuffer) hasRoom(size int64) bool {
+	entries, bytes := b.usage()
+	return (b.maxEntries <= 0 || entries < b.maxEntries) && (b.maxBytes <= 0 || bytes+size <= b.maxBytes)
+}
+
+func (b *boundedBuffer) setFull(full bool) {
+	if full && atomic.CompareAndSwapInt32(&b.full, 0, 1) {
+		entries, bytes := b.usage()
+		log.Printf(fmt.Sprintf("WARN: buffer is full (%d entries, %d bytes), overflow policy [%s]", entries, bytes, b.policy))
+	} else if !full && atomic.CompareAndSwapInt32(&b.full, 1, 0) {
+		log.Printf("INFO: buffer is no longer full")
+	}
+}
+
+// reserve counts an incoming log entry towards buffer usage if there is room for it, returns false otherwise.
+// Room is checked and reserved under lock, so that concurrent incoming log entries can not overfill the buffer.
+func (b *boundedBuffer) reserve(size int64) bool {
+	b.reserveLock.Lock()
+	defer b.reserveLock.Unlock()
+	if !b.hasRoom(size) {
+		return false
+	}
+	atomic.AddInt64(&b.entries, 1)
+	atomic.AddInt64(&b.bytes, size)
+	return true
+}
+
+// unreserve releases room reserved for an incoming log entry that could not be put to buffer
+func (b *boundedBuffer) unreserve(size int64) {
+	atomic.AddInt64(&b.entries, -1)
+	atomic.AddInt64(&b.bytes, -size)
+}
+
+// admit reserves room in buffer for an incoming log entry, dropping buffered log entries if overflow policy allows.
+// Returns errBufferFull if the log entry must be rejected. The reserved room must be released (see unreserve) if the
+// log entry is not put to buffer afterwards.
+func (b *boundedBuffer) admit(entry *logger.LogEntry, size int64) error {
+	if b.reserve(size) {
+		b.setFull(false)
+		return nil
+	}
+	if b.policy == overflowReject || (b.maxBytes > 0 && size > b.maxBytes) {
+		b.setFull(true)
+		return errBufferFull
+	}
+	b.dropLock.Lock()
+	defer b.dropLock.Unlock()
+	for i := 0; !b.reserve(size); i++ {
+		if i >= maxDropsPerEntry || !b.dropOne(entry) {
+			b.setFull(true)
+			return errBufferFull
+		}
+	}
+	b.setFull(false)
+	return nil
+}
+
+// offer puts an incoming log entry to buffer if there is room for it (see admit)
+func (b *boundedBuffer) offer(entry *logger.LogEntry, payload []byte) error {
+	size := int64(len(payload))
+	if err := b.admit(entry, size); err != nil {
+		return err
+	}
+	if _, err := b.IQueue.Queue(singu.NewQueueMessage(payload)); err != nil {
+		b.unreserve(size)
+		return err
+	}
+	return nil
+}
+
+// dropOne drops a buffered log entry to make room for an incoming one, returns false if there is nothing to drop.
+// Dropped log entries are moved to dead-letter storage (if enabled).
+func (b *boundedBuffer) dropOne(entry *logger.LogEntry) bool {
+	cat, _ := getLogWriter(entry.Category)
+	candidates := make([]string, 0)
+	switch b.policy {
+	case overflowDropPriority:
+		// categories of lower priority first, categories of higher priority than the incoming entry are never dropped
+		priority := writerPriority(cat)
+		for _, c := range b.categories() {
+			if writerPriority(c) <= priority {
+				candidates = append(candidates, c)
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool { return writerPriority(candidates[i]) < writerPriority(candidates[j]) })
+	case overflowDropCategory:
+		// oldest entries of the incoming entry's category first, then of other categories
+		candidates = append(candidates, cat)
+		candidates = append(candidates, b.categories()...)
+	}
+	var msg *singu.QueueMessage
+	var err error
+	if b.policy == overflowDropOldest {
+		// shared buffer: the oldest entry is at the head of the queue
+		msg, err = b.Take()
+	}
+	for _, c := range candidates {
+		if msg, err = b.takeFrom(c); err != nil || msg != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf(fmt.Sprintf("ERROR: error taking message from buffer to drop: %e", err))
+	}
+	if msg == nil {
+		return false
+	}
+	droppedCat := ""
+	dropped, err := logger.UnmarshalLogEntry(msg.Payload)
+	if err == nil {
+		droppedCat, _ = getLogWriter(dropped.Category)
+	}
+	if err := b.Finish(msg.Id); err != nil {
+		log.Printf(fmt.Sprintf("ERROR: error dropping message %s from buffer: %e", msg.Id, err))
+		return false
+	}
+	metricBufferDropped.WithLabelValues(droppedCat).Inc()
+	if dropped != nil {
+		putDeadLetter(droppedCat, msg.Id, dropped, errBufferDropped, dropped.Attempts, msg.Timestamp)
+	}
+	return true
+}
+
+// writerPriority returns priority of the log writer handling a category
+func writerPriority(cat string) int {
+	if _, lwi := getLogWriter(cat); lwi != nil {
+		return lwi.Priority
+	}
+	return 0
+}
+
+func (b *boundedBuffer) track(msg *singu.QueueMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.taken[msg.Id] = int64(len(msg.Payload))
+}
+
+func (b *boundedBuffer) untrack(id string) (int64, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	size, ok := b.taken[id]
+	delete(b.taken, id)
+	return size, ok
+}
+
+// Destroy closes the underlying buffer, saving usage of persistent buffer (see loadBufferUsage)
+func (b *boundedBuffer) Destroy() {
+	if b.usageFile != "" {
+		entries, bytes := b.usage()
+		data, _ := json.Marshal(bufferCheckpoint{Entries: entries, Bytes: bytes})
+		if err := ioutil.WriteFile(b.usageFile, data, 0644); err != nil {
+			log.Printf(fmt.Sprintf("WARN: error saving buffer usage to [%s]: %e", b.usageFile, err))
+		}
+	}
+	if d, ok := b.IQueue.(interface{ Destroy() }); ok {
+		d.Destroy()
+	}
+}
+
+// Queue implements IQueue.Queue. Limits are not checked here (see admit), so that log entries already in buffer can
+// always be put back for retrying.
+func (b *boundedBuffer) Queue(msg *singu.QueueMessage) (*singu.QueueMessage, error) {
+	result, err := b.IQueue.Queue(msg)
+	if err == nil {
+		atomic.AddInt64(&b.entries, 1)
+		atomic.AddInt64(&b.bytes, int64(len(msg.Payload)))
+	}
+	return result, err
+}
+
+// Requeue implements IQueue.Requeue
+func (b *boundedBuffer) Requeue(id string, silent bool) (*singu.QueueMessage, error) {
+	msg, err := b.IQueue.Requeue(id, silent)
+	if err == nil && msg != nil {
+		b.untrack(id)
+	}
+	return msg, err
+}
+
+// Finish implements IQueue.Finish
+func (b *boundedBuffer) Finish(id string) error {
+	err := b.IQueue.Finish(id)
+	if err == nil {
+		if size, ok := b.untrack(id); ok {
+			atomic.AddInt64(&b.entries, -1)
+			atomic.AddInt64(&b.bytes, -size)
+		}
+	}
+	return err
+}
+
+// Take implements IQueue.Take
+func (b *boundedBuffer) Take() (*singu.QueueMessage, error) {
+	msg, err := b.IQueue.Take()
+	if msg != nil {
+		b.track(msg)
+	}
+	return msg, err
+}
+
+// OrphanMessages implements IQueue.OrphanMessages
+func (b *boundedBuffer) OrphanMessages(numSeconds, numMessages int) ([]*singu.QueueMessage, error) {
+	msgs, err := b.IQueue.OrphanMessages(numSeconds, numMessages)
+	for _, msg := range msgs {
+		b.track(msg)
+	}
+	return msgs, err
+}
+
+// categories implements categoryQueues.categories
+func (b *boundedBuffer) categories() []string {
+	if cq, ok := b.IQueue.(categoryQueues); ok {
+		return cq.categories()
+	}
+	return nil
+}
+
+// takeFrom implements categoryQueues.takeFrom
+func (b *boundedBuffer) takeFrom(cat string) (*singu.QueueMessage, error) {
+	cq, ok := b.IQueue.(categoryQueues)
+	if !ok {
+		return nil, singu.ErrorOperationNotSupported
+	}
+	msg, err := cq.takeFrom(cat)
+	if msg != nil {
+		b.track(msg)
+	}
+	return msg, err
+}
+
+// removeIdle implements categoryQueues.removeIdle
+func (b *boundedBuffer) removeIdle(cat string) bool {
+	if cq, ok := b.IQueue.(categoryQueues); ok {
+		return cq.removeIdle(cat)
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package prista
+
+import (
+	"fmt"
+	"github.com/btnguyen2k/singu"
+	"github.com/go-akka/configuration"
+	"main/src/logger"
+	"sync"
+	"testing"
+)
+
+func newTestBoundedBuffer(t *testing.T, perCategory bool, conf string) *boundedBuffer {
+	var queue singu.IQueue = singu.NewInmemQueue("test", 1000, false, 0)
+	if perCategory {
+		var err error
+		if queue, err = newCategoryBuffer(memoryBufferBackend, nil, ""); err != nil {
+			t.Fatalf("error creating per-category buffer: %s", err)
+		}
+	}
+	b, err := newBoundedBuffer(queue, configuration.ParseString(conf), 0, 0)
+	if err != nil {
+		t.Fatalf("error creating bounded buffer: %s", err)
+	}
+	return b
+}
+
+// bufferedMessages takes all messages waiting in buffer, returns their messages grouped by category
+func bufferedMessages(b *boundedBuffer) map[string][]string {
+	result := make(map[string][]string)
+	for {
+		msg, _ := b.Take()
+		if msg == nil {
+			return result
+		}
+		entry, _ := logger.UnmarshalLogEntry(msg.Payload)
+		result[entry.Category] = append(result[entry.Category], entry.Message)
+	}
+}
+
+func TestBoundedBufferAdmit(t *testing.T) {
+	defer func(lw map[string]*logger.LogWriterAndInfo) { LogWriters = lw }(LogWriters)
+	LogWriters = map[string]*logger.LogWriterAndInfo{
+		"default": {Priority: 0},
+		"low":     {Priority: -1},
+		"high":    {Priority: 1},
+	}
+	type entry struct {
+		category string
+		message  string
+		ok       bool
+	}
+	testCases := []struct {
+		name        string
+		perCategory bool
+		conf        string
+		entries     []entry
+		expected    map[string][]string // messages left in buffer, by category
+	}{
+		{"no limit", false, ``,
+			[]entry{{"default", "1", true}, {"default", "2", true}, {"default", "3", true}},
+			map[string][]string{"default": {"1", "2", "3"}}},
+		{"reject by max_entries", false, `buffer.max_entries = 2`,
+			[]entry{{"default", "1", true}, {"default", "2", true}, {"default", "3", false}},
+			map[string][]string{"default": {"1", "2"}}},
+		{"reject by max_bytes", false, `buffer.max_bytes = 100`,
+			[]entry{{"default", "1", true}, {"default", "2", true}, {"default", "3", false}},
+			map[string][]string{"default": {"1", "2"}}},
+		{"drop_oldest", false, `buffer { max_entries = 2, overflow_policy = drop_oldest }`,
+			[]entry{{"default", "1", true}, {"default", "2", true}, {"default", "3", true}, {"default", "4", true}},
+			map[string][]string{"default": {"3", "4"}}},
+		{"drop_oldest entry larger than max_bytes", false, `buffer { max_bytes = 10, overflow_policy = drop_oldest }`,
+			[]entry{{"default", "1", false}},
+			map[string][]string{}},
+		{"drop_category_oldest same category first", true, `buffer { max_entries = 3, overflow_policy = drop_category_oldest }`,
+			[]entry{{"low", "1", true}, {"high", "2", true}, {"high", "3", true}, {"high", "4", true}},
+			map[string][]string{"low": {"1"}, "high": {"3", "4"}}},
+		{"drop_category_oldest other categories", true, `buffer { max_entries = 2, overflow_policy = drop_category_oldest }`,
+			[]entry{{"low", "1", true}, {"high", "2", true}, {"default", "3", true}},
+			map[string][]string{"low": {"1"}, "default": {"3"}}},
+		{"drop_priority lower priority first", true, `buffer { max_entries = 2, overflow_policy = drop_priority }`,
+			[]entry{{"high", "1", true}, {"low", "2", true}, {"default", "3", true}},
+			map[string][]string{"high": {"1"}, "default": {"3"}}},
+		{"drop_priority never drops higher priority", true, `buffer { max_entries = 2, overflow_policy = drop_priority }`,
+			[]entry{{"high", "1", true}, {"high", "2", true}, {"low", "3", false}},
+			map[string][]string{"high": {"1", "2"}}},
+	}
+	for _, tc := range testCases {
+		b := newTestBoundedBuffer(t, tc.perCategory, tc.conf)
+		for _, e := range tc.entries {
+			le := newLogEntry(e.category, e.message, gatewayHttp, "")
+			if err := b.offer(le, le.Marshal()); (err == nil) != e.ok {
+				t.Errorf("%s: entry %s/%s: expected accepted=%v but received error %v", tc.name, e.category, e.message, e.ok, err)
+			}
+		}
+		messages := bufferedMessages(b)
+		if fmt.Sprintf("%v", messages) != fmt.Sprintf("%v", tc.expected) {
+			t.Errorf("%s: expected %v left in buffer but received %v", tc.name, tc.expected, messages)
+		}
+	}
+}
+
+func TestBoundedBufferPolicies(t *testing.T) {
+	testCases := []struct {
+		policy      string
+		perCategory bool
+		ok          bool
+	}{
+		{overflowReject, false, true},
+		{overflowReject, true, true},
+		{overflowDropOldest, false, true},
+		{overflowDropOldest, true, false},
+		{overflowDropCategory, false, false},
+		{overflowDropCategory, true, true},
+		{overflowDropPriority, false, false},
+		{overflowDropPriority, true, true},
+		{"drop_newest", false, false},
+	}
+	for _, tc := range testCases {
+		var queue singu.IQueue = singu.NewInmemQueue("test", 10, false, 0)
+		if tc.perCategory {
+			queue, _ = newCategoryBuffer(memoryBufferBackend, nil, "")
+		}
+		_, err := newBoundedBuffer(queue, configuration.ParseString(fmt.Sprintf(`buffer.overflow_policy = %s`, tc.policy)), 0, 0)
+		if (err == nil) != tc.ok {
+			t.Errorf("policy [%s], per-category %v: expected valid=%v but received error %v", tc.policy, tc.perCategory, tc.ok, err)
+		}
+	}
+}
+
+func TestBoundedBufferConcurrentAdmit(t *testing.T) {
+	b := newTestBoundedBuffer(t, false, `buffer.max_entries = 10`)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	numAccepted := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entry := newLogEntry("default", fmt.Sprintf("%d", i), gatewayHttp, "")
+			if b.offer(entry, entry.Marshal()) == nil {
+				lock.Lock()
+				numAccepted++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if entries, _ := b.usage(); numAccepted != 10 || entries != 10 {
+		t.Errorf("expected 10 entries accepted and counted but received %d accepted and %d counted", numAccepted, entries)
+	}
+}
+
+func TestBoundedBufferOfferFailed(t *testing.T) {
+	// the underlying queue is full before the bounded buffer is
+	b, _ := newBoundedBuffer(singu.NewInmemQueue("test", 1, false, 0), configuration.ParseString(`buffer.max_entries = 10`), 0, 0)
+	for i, expected := range []error{nil, singu.ErrorQueueIsFull} {
+		entry := newLogEntry("default", fmt.Sprintf("%d", i), gatewayHttp, "")
+		if err := b.offer(entry, entry.Marshal()); err != expected {
+			t.Errorf("entry #%d: expected error %v but received %v", i, expected, err)
+		}
+	}
+	if entries, bytes := b.usage(); entries != 1 || bytes <= 0 {
+		t.Errorf("expected reservation of rejected entry to be released but buffer usage is %d entries, %d bytes", entries, bytes)
+	}
+}
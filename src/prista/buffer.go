@@ -0,0 +1,585 @@
+package prista
+
+import (
+	"fmt"
+	"github.com/btnguyen2k/singu"
+	"github.com/btnguyen2k/singu/leveldb"
+	"github.com/go-akka/configuration"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"main/src/logger"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	sharedBufferName      = "buffer"  // name of the shared buffer queue, stored under <temp_dir>/buffer
+	categoryBuffersDir    = "buffers" // per-category buffer queues are stored under <temp_dir>/buffers/<category>
+	defaultBufferCategory = "default"
+	defaultBufferType     = "leveldb"
+	defaultMemoryEntries  = 100000
+	// default cap of number of per-category buffer queues, log entries of categories beyond the cap go to the "default" queue
+	defaultMaxCategoryQueues = 100
+)
+
+// bufferBackend is a storage backend of buffer queues, selected by "buffer.type"
+type bufferBackend struct {
+	persistent bool   // true if buffered messages survive restarts
+	durability string // durability guarantee of the backend
+	// newQueue creates a buffer queue: dir is the directory to store data of the queue (ignored by non-persistent backends),
+	// conf is configurations of the backend (block "buffer.<type>", may be nil)
+	newQueue func(name, dir string, conf *configuration.Config) (singu.IQueue, error)
+	// maxEntries returns max number of messages the backend keeps in total across all its queues (0 = no limit), may be nil
+	maxEntries func(conf *configuration.Config) int64
+}
+
+var bufferBackends = make(map[string]*bufferBackend)
+
+// registerBufferBackend makes a buffer backend available to "buffer.type"
+func registerBufferBackend(bufferType string, backend *bufferBackend) {
+	bufferBackends[bufferType] = backend
+}
+
+var leveldbBufferBackend = &bufferBackend{
+	persistent: true,
+	durability: "messages are persisted to disk (LevelDB) before being acknowledged to clients, and survive restarts and crashes",
+	newQueue: func(name, dir string, conf *configuration.Config) (singu.IQueue, error) {
+		queue := leveldb.NewLeveldbQueue(name, dir, 0, false, 0)
+		return queue, queue.(*leveldb.LeveldbQueue).Init()
+	},
+}
+
+var memoryBufferBackend = &bufferBackend{
+	persistent: false,
+	durability: "messages are kept in memory only: buffered messages are lost if the process crashes, and on shutdown if not written before shutdown_timeout",
+	newQueue: func(name, dir string, conf *configuration.Config) (singu.IQueue, error) {
+		// total across queues of per-category buffer is limited by the bounded buffer (see initBuffer)
+		return singu.NewInmemQueue(name, int(memoryMaxEntries(conf)), false, 0), nil
+	},
+	maxEntries: memoryMaxEntries,
+}
+
+// memoryMaxEntries returns max number of messages kept by "memory" buffer [buffer.memory.max_entries]
+func memoryMaxEntries(conf *configuration.Config) int64 {
+	maxEntries := conf.GetInt64("max_entries", defaultMemoryEntries)
+	if maxEntries <= 0 {
+		maxEntries = defaultMemoryEntries
+	}
+	return maxEntries
+}
+
+func init() {
+	registerBufferBackend("leveldb", leveldbBufferBackend)
+	registerBufferBackend("memory", memoryBufferBackend)
+}
+
+// bufferPersistent is true if buffer backend in use keeps buffered messages across restarts
+var bufferPersistent = true
+
+func initBuffer(config *configuration.Config) singu.IQueue {
+	bufferType := strings.ToLower(strings.TrimSpace(config.GetString("buffer.type", defaultBufferType)))
+	backend, ok := bufferBackends[bufferType]
+	if !ok {
+		panic(fmt.Sprintf("unknown buffer type [%s]", bufferType))
+	}
+	backendConf := config.GetConfig("buffer." + bufferType)
+	bufferPersistent = backend.persistent
+	perCategory := config.GetBoolean("buffer.per_category", false)
+	tempDir := config.GetString("temp_dir", "./temp")
+	sharedDir := filepath.Join(tempDir, sharedBufferName)
+	categoriesDir := filepath.Join(tempDir, categoryBuffersDir)
+
+	var queue singu.IQueue
+	var err error
+	if perCategory {
+		var cb *categoryBuffer
+		if cb, err = newCategoryBuffer(backend, backendConf, categoriesDir); err == nil {
+			cb.maxQueues = int(config.GetInt32("buffer.max_category_queues", defaultMaxCategoryQueues))
+		}
+		queue = cb
+	} else {
+		queue, err = backend.newQueue(sharedBufferName, tempDir, backendConf)
+	}
+	if err != nil {
+		panic(err)
+	}
+	// messages already in buffer are counted towards buffer.max_entries and buffer.max_bytes
+	var entries, bytes int64
+	usageFile := ""
+	if backend.persistent {
+		usageFile = filepath.Join(tempDir, bufferUsageFile)
+		if entries, bytes, err = loadBufferUsage(queue, usageFile); err != nil {
+			panic(err)
+		}
+	}
+	buffer, err := newBoundedBuffer(queue, config, entries, bytes)
+	if err != nil {
+		panic(err)
+	}
+	buffer.usageFile = usageFile
+	if backend.maxEntries != nil {
+		// limit of the backend applies to all its queues together (e.g. all category queues of per-category buffer)
+		if maxEntries := backend.maxEntries(backendConf); buffer.maxEntries <= 0 || buffer.maxEntries > maxEntries {
+			buffer.maxEntries = maxEntries
+		}
+	}
+
+	// messages left in LevelDB buffer of another layout (or when switching to another buffer type) are migrated
+	if (backend != leveldbBufferBackend || perCategory) && isDir(sharedDir) {
+		source, err := leveldbBufferBackend.newQueue(sharedBufferName, tempDir, nil)
+		if err != nil {
+			panic(err)
+		}
+		done := migrateBuffer(source, buffer, "shared buffer", bufferType+" buffer")
+		source.(*leveldb.LeveldbQueue).Destroy()
+		removeMigratedBuffer(sharedDir, done)
+	}
+	if (backend != leveldbBufferBackend || !perCategory) && isDir(categoriesDir) {
+		source, err := newCategoryBuffer(leveldbBufferBackend, nil, categoriesDir)
+		if err != nil {
+			panic(err)
+		}
+		done := migrateBuffer(source, buffer, "per-category buffer", bufferType+" buffer")
+		source.Destroy()
+		removeMigratedBuffer(categoriesDir, done)
+	}
+
+	log.Printf("Buffer type [%s], per-category: %t (%s)", bufferType, perCategory, backend.durability)
+	entries, bytes = buffer.usage()
+	log.Printf("Buffer limits: max_entries=%d, max_bytes=%d, overflow policy [%s]; %d entries (%d bytes) in buffer",
+		buffer.maxEntries, buffer.maxBytes, buffer.policy, entries, bytes)
+	return buffer
+}
+
+// removeMigratedBuffer removes storage of a migrated buffer. If not all messages have been migrated, the storage is kept
+// and migration is retried on next start.
+func removeMigratedBuffer(dir string, done bool) {
+	if !done {
+		log.Printf(fmt.Sprintf("ERROR: not all messages have been migrated from [%s], migration is retried on next start", dir))
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf(fmt.Sprintf("WARN: error removing directory [%s]: %e", dir, err))
+	}
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// migrateBuffer moves all messages (including ones left in ephemeral storage) from a buffer to another, returns true if
+// all messages have been moved. Messages keep their original queue timestamps, so that retry_seconds is still counted
+// from the time they were first buffered.
+func migrateBuffer(source, target singu.IQueue, sourceName, targetName string) bool {
+	move := func(msg *singu.QueueMessage) bool {
+		if _, err := target.Queue(msg); err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error moving message %s from %s to %s: %e", msg.Id, sourceName, targetName, err))
+			return false
+		}
+		if err := source.Finish(msg.Id); err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error finishing message %s in %s: %e", msg.Id, sourceName, err))
+		}
+		return true
+	}
+	numMoved := 0
+	// messages taken but not finished (i.e. orphan messages) are moved as well
+	orphans, err := source.OrphanMessages(-1, 0)
+	if err != nil {
+		log.Printf(fmt.Sprintf("ERROR: error fetching orphan messages from %s: %e", sourceName, err))
+	}
+	for _, msg := range orphans {
+		if move(msg) {
+			numMoved++
+		}
+	}
+	for {
+		msg, err := source.Take()
+		if err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error taking message from %s: %e", sourceName, err))
+			break
+		}
+		if msg == nil || !move(msg) {
+			break
+		}
+		numMoved++
+	}
+	log.Printf("INFO: %d message(s) migrated from %s to %s", numMoved, sourceName, targetName)
+	queueSize, err1 := source.QueueSize()
+	ephemeralSize, err2 := source.EphemeralSize()
+	return err1 == nil && err2 == nil && queueSize == 0 && ephemeralSize == 0
+}
+
+/*----------------------------------------------------------------------*/
+
+// categoryBuffer is a buffer that keeps a separate queue per category, so that a backlog of one category does not delay
+// the others. Log entries are put to the queue of the category of the log writer handling them (categories without their
+// own log writer share the "default" queue), hence clients can not create queues by sending arbitrary categories:
+//	- number of queues is capped by maxQueues, log entries of categories beyond the cap are put to the "default" queue
+//	- queues of categories that no longer have their own log writer (e.g. removed by reloading configurations, or left
+//	  from a previous run) are closed and removed once empty (see removeIdle)
+type categoryBuffer struct {
+	backend   *bufferBackend
+	conf      *configuration.Config // configurations of the backend
+	dir       string
+	maxQueues int
+	lock      sync.RWMutex
+	queues    map[string]singu.IQueue // keyed by category, each stored in its own directory (see categoryDirName)
+	takenLock sync.Mutex
+	taken     map[string]singu.IQueue // message id -> queue holding the message in its ephemeral storage
+}
+
+func newCategoryBuffer(backend *bufferBackend, conf *configuration.Config, dir string) (*categoryBuffer, error) {
+	buffer := &categoryBuffer{backend: backend, conf: conf, dir: dir, maxQueues: defaultMaxCategoryQueues,
+		queues: make(map[string]singu.IQueue), taken: make(map[string]singu.IQueue)}
+	if !backend.persistent {
+		return buffer, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// open queues of existing categories, which may still have messages (they are opened even if exceeding the cap)
+	for _, cat := range storedCategories(dir) {
+		var err error
+		if buffer.queues[cat], err = backend.newQueue(categoryDirName(cat), dir, conf); err != nil {
+			return nil, err
+		}
+	}
+	return buffer, nil
+}
+
+// storedCategories returns categories of existing category queues stored in a directory
+func storedCategories(dir string) []string {
+	result := make([]string, 0)
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if cat, ok := categoryFromDirName(fi.Name()); fi.IsDir() && ok {
+			result = append(result, cat)
+		}
+	}
+	return result
+}
+
+// queue returns queue of a category, the queue is created if not exist. If the number of queues has reached the cap,
+// the "default" queue is returned instead.
+func (b *categoryBuffer) queue(cat string) (singu.IQueue, error) {
+	b.lock.RLock()
+	q := b.queues[cat]
+	b.lock.RUnlock()
+	if q != nil {
+		return q, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q = b.queues[cat]; q != nil {
+		return q, nil
+	}
+	if cat != defaultBufferCategory && b.maxQueues > 0 && len(b.queues) >= b.maxQueues {
+		log.Printf(fmt.Sprintf("WARN: number of category queues reached its cap %d [buffer.max_category_queues], log entries of category [%s] are put to queue of [%s]",
+			b.maxQueues, cat, defaultBufferCategory))
+		if cat, q = defaultBufferCategory, b.queues[defaultBufferCategory]; q != nil {
+			return q, nil
+		}
+	}
+	var err error
+	if q, err = b.backend.newQueue(categoryDirName(cat), b.dir, b.conf); err != nil {
+		return nil, err
+	}
+	b.queues[cat] = q
+	return q, nil
+}
+
+// removeIdle closes and removes queue of a category that no longer has its own log writer, if the queue is empty (no
+// message waiting or being written). Returns true if the queue has been removed.
+func (b *categoryBuffer) removeIdle(cat string) bool {
+	if writerCat, _ := getLogWriter(cat); writerCat == cat || cat == defaultBufferCategory {
+		return false
+	}
+	// queues are used under read lock (see Queue and each), so they are not in use while being removed
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	q := b.queues[cat]
+	if q == nil {
+		return false
+	}
+	queueSize, err1 := q.QueueSize()
+	ephemeralSize, err2 := q.EphemeralSize()
+	if err1 != nil || err2 != nil || queueSize > 0 || ephemeralSize > 0 {
+		return false
+	}
+	delete(b.queues, cat)
+	if d, ok := q.(interface{ Destroy() }); ok {
+		d.Destroy()
+	}
+	if b.backend.persistent {
+		if err := os.RemoveAll(filepath.Join(b.dir, categoryDirName(cat))); err != nil {
+			log.Printf(fmt.Sprintf("WARN: error removing buffer queue of category [%s]: %e", cat, err))
+		}
+	}
+	log.Printf("INFO: buffer queue of category [%s] is empty and category has no log writer of its own, queue removed", cat)
+	return true
+}
+
+// each calls f for queues of all categories, stops at the first error
+func (b *categoryBuffer) each(f func(q singu.IQueue) error) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, cat := range b.sortedCategories() {
+		if err := f(b.queues[cat]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// categories returns categories having a queue, sorted
+func (b *categoryBuffer) categories() []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.sortedCategories()
+}
+
+// sortedCategories returns categories having a queue, sorted. Caller must hold b.lock.
+func (b *categoryBuffer) sortedCategories() []string {
+	result := make([]string, 0, len(b.queues))
+	for cat := range b.queues {
+		result = append(result, cat)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (b *categoryBuffer) track(q singu.IQueue, msg *singu.QueueMessage) {
+	b.takenLock.Lock()
+	defer b.takenLock.Unlock()
+	b.taken[msg.Id] = q
+}
+
+// takenFrom returns the queue holding a taken message (and stops tracking the message), or nil if not known
+func (b *categoryBuffer) takenFrom(id string) singu.IQueue {
+	b.takenLock.Lock()
+	defer b.takenLock.Unlock()
+	q := b.taken[id]
+	delete(b.taken, id)
+	return q
+}
+
+// takeFrom takes a message from queue of a category, returns nil if the category has no queue
+func (b *categoryBuffer) takeFrom(cat string) (*singu.QueueMessage, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	q := b.queues[cat]
+	if q == nil {
+		return nil, nil
+	}
+	msg, err := q.Take()
+	if msg != nil {
+		b.track(q, msg)
+	}
+	return msg, err
+}
+
+// Destroy closes all category queues
+func (b *categoryBuffer) Destroy() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, q := range b.queues {
+		if d, ok := q.(interface{ Destroy() }); ok {
+			d.Destroy()
+		}
+	}
+}
+
+// Name implements IQueue.Name
+func (b *categoryBuffer) Name() string {
+	return sharedBufferName
+}
+
+// QueueStorageCapacity implements IQueue.QueueStorageCapacity
+func (b *categoryBuffer) QueueStorageCapacity() (int, error) {
+	return singu.SizeNotSupported, nil
+}
+
+// EphemeralStorageCapacity implements IQueue.EphemeralStorageCapacity
+func (b *categoryBuffer) EphemeralStorageCapacity() (int, error) {
+	return singu.SizeNotSupported, nil
+}
+
+// IsEphemeralStorageEnabled implements IQueue.IsEphemeralStorageEnabled
+func (b *categoryBuffer) IsEphemeralStorageEnabled() bool {
+	return true
+}
+
+// Queue implements IQueue.Queue, the message is put to queue of the category of the log writer handling the log entry
+func (b *categoryBuffer) Queue(msg *singu.QueueMessage) (*singu.QueueMessage, error) {
+	cat := defaultBufferCategory
+	if entry, err := logger.UnmarshalLogEntry(msg.Payload); err == nil {
+		cat, _ = getLogWriter(entry.Category)
+	}
+	for {
+		q, err := b.queue(cat)
+		if err != nil {
+			return nil, err
+		}
+		// the queue is used under read lock, so that it is not removed meanwhile (see removeIdle)
+		b.lock.RLock()
+		if b.queues[cat] == q || b.queues[defaultBufferCategory] == q {
+			result, err := q.Queue(msg)
+			b.lock.RUnlock()
+			return result, err
+		}
+		// queue has been removed since being looked up
+		b.lock.RUnlock()
+	}
+}
+
+// Requeue implements IQueue.Requeue
+func (b *categoryBuffer) Requeue(id string, silent bool) (*singu.QueueMessage, error) {
+	if q := b.takenFrom(id); q != nil {
+		return q.Requeue(id, silent)
+	}
+	var result *singu.QueueMessage
+	err := b.each(func(q singu.IQueue) error {
+		var err error
+		if result == nil {
+			result, err = q.Requeue(id, silent)
+		}
+		return err
+	})
+	return result, err
+}
+
+// Finish implements IQueue.Finish
+func (b *categoryBuffer) Finish(id string) error {
+	if q := b.takenFrom(id); q != nil {
+		return q.Finish(id)
+	}
+	return b.each(func(q singu.IQueue) error { return q.Finish(id) })
+}
+
+// Take implements IQueue.Take, messages are taken from category queues in turn
+func (b *categoryBuffer) Take() (*singu.QueueMessage, error) {
+	for _, cat := range b.categories() {
+		if msg, err := b.takeFrom(cat); err != nil || msg != nil {
+			return msg, err
+		}
+	}
+	return nil, nil
+}
+
+// OrphanMessages implements IQueue.OrphanMessages
+func (b *categoryBuffer) OrphanMessages(numSeconds, numMessages int) ([]*singu.QueueMessage, error) {
+	result := make([]*singu.QueueMessage, 0)
+	err := b.each(func(q singu.IQueue) error {
+		msgs, err := q.OrphanMessages(numSeconds, numMessages)
+		for _, msg := range msgs {
+			b.track(q, msg)
+			result = append(result, msg)
+		}
+		return err
+	})
+	return result, err
+}
+
+func (b *categoryBuffer) size(f func(q singu.IQueue) (int, error)) (int, error) {
+	total := 0
+	err := b.each(func(q singu.IQueue) error {
+		size, err := f(q)
+		total += size
+		return err
+	})
+	return total, err
+}
+
+// QueueSize implements IQueue.QueueSize
+func (b *categoryBuffer) QueueSize() (int, error) {
+	return b.size(func(q singu.IQueue) (int, error) { return q.QueueSize() })
+}
+
+// EphemeralSize implements IQueue.EphemeralSize
+func (b *categoryBuffer) EphemeralSize() (int, error) {
+	return b.size(func(q singu.IQueue) (int, error) { return q.EphemeralSize() })
+}
+
+/*----------------------------------------------------------------------*/
+
+// registerBufferAdminApi registers admin API (under group /admin) to inspect and purge per-category buffer:
+//	- GET /admin/buffer: number of messages waiting in buffer, and being written, per category
+//	- DELETE /admin/buffer/:category: purge messages waiting in buffer of a category (moved to dead-letter storage if enabled)
+// Note: ":category" is the category name, URL-escaped
+func registerBufferAdminApi(admin *echo.Group) {
+	admin.GET("/buffer", httpHandlerBufferCategories)
+	admin.DELETE("/buffer/:category", httpHandlerBufferPurge)
+}
+
+// categoryBufferOf returns the per-category buffer underneath a (bounded) buffer, or nil if buffer is not per-category
+func categoryBufferOf(buffer singu.IQueue) *categoryBuffer {
+	if bb, ok := buffer.(*boundedBuffer); ok {
+		buffer = bb.IQueue
+	}
+	cb, _ := buffer.(*categoryBuffer)
+	return cb
+}
+
+func httpHandlerBufferCategories(c echo.Context) error {
+	buffer := categoryBufferOf(Buffer)
+	if buffer == nil {
+		return dlqResponse(c, http.StatusNotFound, "Per-category buffer is disabled", nil)
+	}
+	result := make(map[string]interface{})
+	buffer.lock.RLock()
+	for _, cat := range buffer.sortedCategories() {
+		queueSize, _ := buffer.queues[cat].QueueSize()
+		ephemeralSize, _ := buffer.queues[cat].EphemeralSize()
+		result[cat] = map[string]int{"queue": queueSize, "ephemeral": ephemeralSize}
+	}
+	buffer.lock.RUnlock()
+	return dlqResponse(c, http.StatusOK, "Ok", result)
+}
+
+func httpHandlerBufferPurge(c echo.Context) error {
+	// messages are purged via the bounded buffer so that they are no longer counted towards buffer limits
+	buffer, ok := Buffer.(categoryQueues)
+	if !ok || buffer.categories() == nil {
+		return dlqResponse(c, http.StatusNotFound, "Per-category buffer is disabled", nil)
+	}
+	name, err := url.PathUnescape(c.Param("category"))
+	if err != nil {
+		name = c.Param("category")
+	}
+	found := false
+	for _, cat := range buffer.categories() {
+		found = found || cat == name
+	}
+	if !found {
+		return dlqResponse(c, http.StatusNotFound, fmt.Sprintf("Buffer of category [%s] not found", name), nil)
+	}
+	numPurged := 0
+	for !isBufferClosed() {
+		msg, err := buffer.takeFrom(name)
+		if err != nil {
+			return dlqResponse(c, http.StatusInternalServerError, err.Error(), map[string]int{"purged": numPurged})
+		}
+		if msg == nil {
+			break
+		}
+		// purged entries are kept in dead-letter storage, they can be replayed if purged by mistake
+		if entry, err := logger.UnmarshalLogEntry(msg.Payload); err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error decoding message %s/%s, purged: %e", msg.Id, string(msg.Payload), err))
+		} else {
+			putDeadLetter(name, msg.Id, entry, errBufferPurged, entry.Attempts, msg.Timestamp)
+		}
+		if err := Buffer.Finish(msg.Id); err != nil {
+			return dlqResponse(c, http.StatusInternalServerError, err.Error(), map[string]int{"purged": numPurged})
+		}
+		numPurged++
+	}
+	log.Printf("INFO: %d message(s) purged from buffer of category [%s]", numPurged, name)
+	return dlqResponse(c, http.StatusOK, "Ok", map[string]int{"purged": numPurged})
+}
@@ -0,0 +1,115 @@
+package prista
+
+import (
+	"fmt"
+	"github.com/btnguyen2k/singu"
+	"github.com/go-akka/configuration"
+	"io/ioutil"
+	"main/src/logger"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMemoryBufferTotalLimit(t *testing.T) {
+	defer func(lw map[string]*logger.LogWriterAndInfo) { LogWriters = lw }(LogWriters)
+	defer func(persistent bool) { bufferPersistent = persistent }(bufferPersistent)
+	LogWriters = map[string]*logger.LogWriterAndInfo{"default": {}, "audit": {}, "web": {}}
+	tempDir, err := ioutil.TempDir("", "prista")
+	if err != nil {
+		t.Fatalf("error creating temp directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	testCases := []struct {
+		name        string
+		conf        string
+		numAccepted int
+	}{
+		{"memory limit across category queues", `memory.max_entries = 4`, 4},
+		{"lower buffer limit", `max_entries = 3, memory.max_entries = 4`, 3},
+		{"higher buffer limit", `max_entries = 10, memory.max_entries = 4`, 4},
+	}
+	for _, tc := range testCases {
+		buffer := initBuffer(configuration.ParseString(fmt.Sprintf(`temp_dir = "%s"
+buffer { type = memory, per_category = true, %s }`, tempDir, tc.conf))).(*boundedBuffer)
+		numAccepted := 0
+		for i := 0; i < 9; i++ {
+			le := newLogEntry([]string{"default", "audit", "web"}[i%3], fmt.Sprintf("%d", i), gatewayHttp, "")
+			if buffer.offer(le, le.Marshal()) == nil {
+				numAccepted++
+			}
+		}
+		if numAccepted != tc.numAccepted {
+			t.Errorf("%s: expected %d log entries accepted but received %d", tc.name, tc.numAccepted, numAccepted)
+		}
+	}
+}
+
+func TestCategoryBufferQueueCap(t *testing.T) {
+	defer func(lw map[string]*logger.LogWriterAndInfo) { LogWriters = lw }(LogWriters)
+	LogWriters = map[string]*logger.LogWriterAndInfo{"default": {}, "audit": {}, "web": {}, "api": {}}
+	testCases := []struct {
+		name       string
+		maxQueues  int
+		categories []string // categories of incoming log entries, in order
+		queues     string   // categories having a queue, sorted
+	}{
+		{"no limit", 0, []string{"audit", "web", "api"}, "api,audit,web"},
+		{"under cap", 3, []string{"audit", "web", "api"}, "api,audit,web"},
+		{"over cap", 2, []string{"audit", "web", "api"}, "audit,default,web"},
+		{"default queue exceeding cap", 2, []string{"audit", "web", "default"}, "audit,default,web"},
+		{"categories without log writer", 2, []string{"foo", "bar", "audit"}, "audit,default"},
+	}
+	for _, tc := range testCases {
+		buffer, _ := newCategoryBuffer(memoryBufferBackend, nil, "")
+		buffer.maxQueues = tc.maxQueues
+		for i, cat := range tc.categories {
+			if _, err := buffer.Queue(singu.NewQueueMessage(newLogEntry(cat, fmt.Sprintf("%d", i), gatewayHttp, "").Marshal())); err != nil {
+				t.Fatalf("%s: error putting log entry to buffer: %s", tc.name, err)
+			}
+		}
+		if queues := strings.Join(buffer.categories(), ","); queues != tc.queues {
+			t.Errorf("%s: expected queues [%s] but received [%s]", tc.name, tc.queues, queues)
+		}
+		if size, _ := buffer.QueueSize(); size != len(tc.categories) {
+			t.Errorf("%s: expected %d log entries in buffer but received %d", tc.name, len(tc.categories), size)
+		}
+	}
+}
+
+func TestCategoryBufferRemoveIdle(t *testing.T) {
+	defer func(lw map[string]*logger.LogWriterAndInfo) { LogWriters = lw }(LogWriters)
+	LogWriters = map[string]*logger.LogWriterAndInfo{"default": {}, "audit": {}}
+	buffer, _ := newCategoryBuffer(memoryBufferBackend, nil, "")
+	for _, cat := range []string{"default", "audit", "foo"} {
+		// queue of "foo" is left from before its log writer was removed
+		q, _ := buffer.queue(cat)
+		q.Queue(singu.NewQueueMessage(newLogEntry(cat, "msg", gatewayHttp, "").Marshal()))
+	}
+	taken := make(map[string]*singu.QueueMessage)
+	testCases := []struct {
+		name    string
+		step    func(cat string)
+		cat     string
+		removed bool
+	}{
+		{"waiting entry", func(cat string) {}, "foo", false},
+		{"entry being written", func(cat string) { taken[cat], _ = buffer.takeFrom(cat) }, "foo", false},
+		{"drained", func(cat string) { buffer.Finish(taken[cat].Id) }, "foo", true},
+		{"already removed", func(cat string) {}, "foo", false},
+		{"category with log writer", func(cat string) { taken[cat], _ = buffer.takeFrom(cat); buffer.Finish(taken[cat].Id) }, "audit", false},
+		{"default category", func(cat string) { taken[cat], _ = buffer.takeFrom(cat); buffer.Finish(taken[cat].Id) }, "default", false},
+	}
+	for _, tc := range testCases {
+		tc.step(tc.cat)
+		if removed := buffer.removeIdle(tc.cat); removed != tc.removed {
+			t.Errorf("%s: expected removed=%v but received %v", tc.name, tc.removed, removed)
+		}
+	}
+	if queues := strings.Join(buffer.categories(), ","); queues != "audit,default" {
+		t.Errorf("expected queues [audit,default] but received [%s]", queues)
+	}
+	if msg, err := buffer.takeFrom("foo"); msg != nil || err != nil {
+		t.Errorf("expected nothing taken from removed queue but received (%v, %v)", msg, err)
+	}
+}
@@ -5,32 +5,40 @@ import (
 	"github.com/go-akka/configuration/hocon"
 	"io/ioutil"
 	"log"
-	"os"
 	"path"
 	"path/filepath"
 )
 
 func loadAppConfig(file string) *hoconf.Config {
-	// save the current directory and chdir back to it when done
-	if curDir, err := os.Getwd(); err != nil {
-		panic(err)
-	} else {
-		defer os.Chdir(curDir)
-	}
+	conf, _ := loadAppConfigFiles(file)
+	return conf
+}
 
+// loadAppConfigFiles loads configurations from file, also returns the list of loaded files (the file itself and the included ones).
+//
+// Included files are resolved relative to directory of the configuration file.
+func loadAppConfigFiles(file string) (*hoconf.Config, []string) {
 	log.Printf("Loading configurations from file [%s]", file)
-	confDir, confFile := path.Split(file)
-	os.Chdir(confDir)
-
-	if data, err := ioutil.ReadFile(confFile); err != nil {
+	loader := &configLoader{baseDir: path.Dir(file), files: []string{file}}
+	if data, err := ioutil.ReadFile(file); err != nil {
 		panic(err)
 	} else {
-		return hoconf.ParseString(string(data), myIncludeCallback)
+		return hoconf.ParseString(string(data), loader.include), loader.files
 	}
 }
 
-func myIncludeCallback(filename string) *hocon.HoconRoot {
-	if files, err := filepath.Glob(filename); err != nil {
+// configLoader resolves included configuration files and keeps track of loaded files
+type configLoader struct {
+	baseDir string
+	files   []string
+}
+
+func (l *configLoader) include(filename string) *hocon.HoconRoot {
+	pattern := filename
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(l.baseDir, pattern)
+	}
+	if files, err := filepath.Glob(pattern); err != nil {
 		panic(err)
 	} else if len(files) == 0 {
 		log.Printf("[WARN] [%s] does not match any file", filename)
@@ -39,10 +47,11 @@ func myIncludeCallback(filename string) *hocon.HoconRoot {
 		var root = hocon.Parse("", nil)
 		for _, f := range files {
 			log.Printf("Loading configurations from file [%s]", f)
+			l.files = append(l.files, f)
 			if data, err := ioutil.ReadFile(f); err != nil {
 				panic(err)
 			} else {
-				node := hocon.Parse(string(data), myIncludeCallback)
+				node := hocon.Parse(string(data), l.include)
 				if node != nil {
 					root.Value().GetObject().Merge(node.Value().GetObject())
 					// merge substitutions
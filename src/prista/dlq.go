@@ -0,0 +1,338 @@
+package prista
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-akka/configuration"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"main/src/logger"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dlqDirName          = "dlq"
+	dlqFileExt          = ".json"
+	defaultDlqListLimit = 100
+)
+
+// deadLetter is a log entry that failed to be written within retry_seconds, kept for inspection and replay
+type deadLetter struct {
+	Id        string           `json:"id"`
+	Entry     *logger.LogEntry `json:"entry"`
+	Error     string           `json:"error"`     // the last error
+	Attempts  int              `json:"attempts"`  // number of write attempts
+	Queued    time.Time        `json:"queued"`    // time the entry was first put to buffer
+	Discarded time.Time        `json:"discarded"` // time the entry was moved to dead-letter storage
+}
+
+// deadLetterStore keeps dead letters as files <dir>/<category>/<id>.json
+type deadLetterStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// DeadLetters is the dead-letter storage, nil if dead-letter storage is disabled
+var DeadLetters *deadLetterStore
+
+var reDlqId = regexp.MustCompile(`^[0-9a-zA-Z_-]+$`)
+
+var (
+	errNoLogWriter  = errors.New("no log writer found for category")
+	errBufferPurged = errors.New("purged from buffer via admin API")
+)
+
+func initDeadLetterStore(config *configuration.Config) *deadLetterStore {
+	if !config.GetBoolean("dead_letter.enabled", false) {
+		return nil
+	}
+	dir := filepath.Join(config.GetString("temp_dir", "./temp"), dlqDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	log.Printf("Dead-letter storage is enabled at [%s]", dir)
+	return &deadLetterStore{dir: dir}
+}
+
+// put stores a dead letter, the file is written to a temp file first and then renamed so that incomplete files are never seen
+func (s *deadLetterStore) put(dl *deadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dir := filepath.Join(s.dir, categoryDirName(dl.Entry.Category))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	js, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(dir, "."+dl.Id+".tmp")
+	if err := ioutil.WriteFile(tmpFile, js, 0644); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, filepath.Join(dir, dl.Id+dlqFileExt))
+}
+
+// ids returns ids of dead letters of a category (identified by its directory name), oldest first
+func (s *deadLetterStore) ids(categoryDir string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, categoryDir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(files))
+	for _, f := range files {
+		if name := f.Name(); !f.IsDir() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, dlqFileExt) {
+			result = append(result, strings.TrimSuffix(name, dlqFileExt))
+		}
+	}
+	// ids are time-based, sorting them sorts dead letters by time
+	sort.Strings(result)
+	return result, nil
+}
+
+// categories returns number of dead letters per category
+func (s *deadLetterStore) categories() (map[string]int, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int)
+	for _, f := range files {
+		if cat, ok := categoryFromDirName(f.Name()); f.IsDir() && ok {
+			if ids, err := s.ids(f.Name()); err != nil {
+				return nil, err
+			} else if len(ids) > 0 {
+				result[cat] = len(ids)
+			}
+		}
+	}
+	return result, nil
+}
+
+// get loads a dead letter, returns nil if not found
+func (s *deadLetterStore) get(categoryDir, id string) (*deadLetter, error) {
+	js, err := ioutil.ReadFile(filepath.Join(s.dir, categoryDir, id+dlqFileExt))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dl := &deadLetter{}
+	if err := json.Unmarshal(js, dl); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid dead letter [%s/%s]: %s", categoryDir, id, err))
+	}
+	if dl.Entry == nil {
+		return nil, errors.New(fmt.Sprintf("invalid dead letter [%s/%s]: no log entry", categoryDir, id))
+	}
+	return dl, nil
+}
+
+// remove deletes a dead letter, returns false if not found
+func (s *deadLetterStore) remove(categoryDir, id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := os.Remove(filepath.Join(s.dir, categoryDir, id+dlqFileExt))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// replay puts a dead letter back to buffer and removes it from dead-letter storage, returns false if not found
+func (s *deadLetterStore) replay(categoryDir, id string) (bool, error) {
+	dl, err := s.get(categoryDir, id)
+	if dl == nil || err != nil {
+		return false, err
+	}
+	if err := handleIncomingMessage(dl.Entry, false); err != nil {
+		return false, err
+	}
+	return s.remove(categoryDir, id)
+}
+
+// putDeadLetter moves a log entry that failed to be written to dead-letter storage (if enabled).
+// cat is category of the log writer that failed to write the entry.
+func putDeadLetter(cat, id string, entry *logger.LogEntry, lastErr error, attempts int, queued time.Time) {
+	if DeadLetters == nil {
+		return
+	}
+	dl := &deadLetter{Id: id, Entry: entry, Error: lastErr.Error(), Attempts: attempts, Queued: queued, Discarded: time.Now()}
+	if err := DeadLetters.put(dl); err != nil {
+		log.Printf(fmt.Sprintf("ERROR: error moving log entry %s of category [%s] to dead-letter storage: %e", id, entry.Category, err))
+	} else {
+		metricDeadLettered.WithLabelValues(cat).Inc()
+	}
+}
+
+/*----------------------------------------------------------------------*/
+
+// registerDlqAdminApi registers admin API (under group /admin) to manage dead letters:
+//	- GET /admin/dlq: number of dead letters per category
+//	- GET /admin/dlq/:category?offset=<offset>&limit=<limit>: list dead letters of a category, oldest first
+//	- GET /admin/dlq/:category/:id: inspect a dead letter
+//	- POST /admin/dlq/:category/replay: replay all dead letters of a category, i.e. put them back to buffer
+//	- POST /admin/dlq/:category/:id/replay: replay a dead letter
+//	- DELETE /admin/dlq/:category: purge all dead letters of a category
+//	- DELETE /admin/dlq/:category/:id: purge a dead letter
+// Note: ":category" is the category name, URL-escaped
+func registerDlqAdminApi(admin *echo.Group) {
+	admin.GET("/dlq", httpHandlerDlqCategories)
+	admin.GET("/dlq/:category", httpHandlerDlqList)
+	admin.GET("/dlq/:category/:id", httpHandlerDlqGet)
+	admin.POST("/dlq/:category/replay", httpHandlerDlqReplayAll)
+	admin.POST("/dlq/:category/:id/replay", httpHandlerDlqReplay)
+	admin.DELETE("/dlq/:category", httpHandlerDlqPurgeAll)
+	admin.DELETE("/dlq/:category/:id", httpHandlerDlqPurge)
+}
+
+func dlqResponse(c echo.Context, status int, message string, data interface{}) error {
+	result := map[string]interface{}{"status": status, "message": message}
+	if data != nil {
+		result["data"] = data
+	}
+	return c.JSON(status, result)
+}
+
+// dlqParams extracts and validates path parameters :category and :id (if any), returns the directory storing dead letters
+// of the category and the id
+func dlqParams(c echo.Context) (string, string, bool) {
+	category, err := url.PathUnescape(c.Param("category"))
+	id := c.Param("id")
+	if DeadLetters == nil || err != nil || category == "" || (id != "" && !reDlqId.MatchString(id)) {
+		return "", id, false
+	}
+	return categoryDirName(category), id, true
+}
+
+func httpHandlerDlqCategories(c echo.Context) error {
+	if DeadLetters == nil {
+		return dlqResponse(c, http.StatusNotFound, "Dead-letter storage is disabled", nil)
+	}
+	categories, err := DeadLetters.categories()
+	if err != nil {
+		return dlqResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	return dlqResponse(c, http.StatusOK, "Ok", categories)
+}
+
+func httpHandlerDlqList(c echo.Context) error {
+	categoryDir, _, ok := dlqParams(c)
+	if !ok {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultDlqListLimit
+	}
+	ids, err := DeadLetters.ids(categoryDir)
+	if err != nil {
+		return dlqResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	result := make([]*deadLetter, 0)
+	for i := offset; i >= 0 && i < len(ids) && len(result) < limit; i++ {
+		if dl, err := DeadLetters.get(categoryDir, ids[i]); err != nil {
+			log.Printf(fmt.Sprintf("WARN: %s", err))
+		} else if dl != nil {
+			result = append(result, dl)
+		}
+	}
+	return dlqResponse(c, http.StatusOK, fmt.Sprintf("%d dead letter(s) in total", len(ids)), result)
+}
+
+func httpHandlerDlqGet(c echo.Context) error {
+	categoryDir, id, ok := dlqParams(c)
+	if !ok {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	dl, err := DeadLetters.get(categoryDir, id)
+	if err != nil {
+		return dlqResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	if dl == nil {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	return dlqResponse(c, http.StatusOK, "Ok", dl)
+}
+
+func httpHandlerDlqReplay(c echo.Context) error {
+	categoryDir, id, ok := dlqParams(c)
+	if !ok {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	if found, err := DeadLetters.replay(categoryDir, id); err != nil {
+		return dlqResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	} else if !found {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	return dlqResponse(c, http.StatusOK, "Ok", nil)
+}
+
+func httpHandlerDlqReplayAll(c echo.Context) error {
+	categoryDir, _, ok := dlqParams(c)
+	if !ok {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	ids, err := DeadLetters.ids(categoryDir)
+	if err != nil {
+		return dlqResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	numReplayed := 0
+	for _, id := range ids {
+		if found, err := DeadLetters.replay(categoryDir, id); err != nil {
+			return dlqResponse(c, http.StatusInternalServerError, fmt.Sprintf("%d dead letter(s) replayed, error replaying [%s]: %s", numReplayed, id, err), nil)
+		} else if found {
+			numReplayed++
+		}
+	}
+	return dlqResponse(c, http.StatusOK, fmt.Sprintf("%d dead letter(s) replayed", numReplayed), nil)
+}
+
+func httpHandlerDlqPurge(c echo.Context) error {
+	categoryDir, id, ok := dlqParams(c)
+	if !ok {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	if found, err := DeadLetters.remove(categoryDir, id); err != nil {
+		return dlqResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	} else if !found {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	return dlqResponse(c, http.StatusOK, "Ok", nil)
+}
+
+func httpHandlerDlqPurgeAll(c echo.Context) error {
+	categoryDir, _, ok := dlqParams(c)
+	if !ok {
+		return dlqResponse(c, http.StatusNotFound, "Not found", nil)
+	}
+	ids, err := DeadLetters.ids(categoryDir)
+	if err != nil {
+		return dlqResponse(c, http.StatusInternalServerError, err.Error(), nil)
+	}
+	numPurged := 0
+	for _, id := range ids {
+		if found, err := DeadLetters.remove(categoryDir, id); err != nil {
+			return dlqResponse(c, http.StatusInternalServerError, fmt.Sprintf("%d dead letter(s) purged, error purging [%s]: %s", numPurged, id, err), nil)
+		} else if found {
+			numPurged++
+		}
+	}
+	return dlqResponse(c, http.StatusOK, fmt.Sprintf("%d dead letter(s) purged", numPurged), nil)
+}
@@ -5,13 +5,20 @@ import (
 	"fmt"
 	"github.com/golang/protobuf/ptypes/empty"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"io"
 	"log"
 	pb "main/src/grpc"
-	"main/src/logger"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 // initialize and start gRPC server
@@ -29,9 +36,26 @@ func initGrpcServer(wg *sync.WaitGroup) bool {
 		return false
 	}
 	var opts []grpc.ServerOption
+	tlsConfig, err := loadServerTlsConfig("server.grpc", "h2")
+	if err != nil {
+		panic(err)
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	// gzip compressor is registered by importing package "google.golang.org/grpc/encoding/gzip"
+	// message size limit is checked against decompressed message
+	bodyLimit := AppConfig.GetByteSize("server.max_request_size")
+	if bodyLimit != nil && bodyLimit.Int64() > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(bodyLimit.Int64())))
+	}
 	grpcServer := grpc.NewServer(opts...)
 	pb.RegisterPLogCollectorServiceServer(grpcServer, &PLogCollectorServiceServer{})
-	log.Printf("Starting [%s] gRPC server on [%s:%d]...\n", AppConfig.GetString("app.name")+" v"+AppConfig.GetString("app.version"), listenAddr, listenPort)
+	// standard gRPC health service, reflecting readiness of the application
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go goUpdateGrpcHealth(healthServer, defaultGrpcHealthInterval)
+	log.Printf("Starting [%s] gRPC server on [%s:%d] (TLS: %t)...\n", AppConfig.GetString("app.name")+" v"+AppConfig.GetString("app.version"), listenAddr, listenPort, tlsConfig != nil)
 	go func() {
 		err := grpcServer.Serve(lis)
 		if err != nil {
@@ -39,9 +63,29 @@ func initGrpcServer(wg *sync.WaitGroup) bool {
 		}
 		wg.Done()
 	}()
+	onShutdown("gRPC server", func(ctx context.Context) {
+		healthServer.Shutdown()
+		// stop accepting new calls, wait for pending ones to complete (or cancel them when ctx is done)
+		done := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(done)
+		}()
+		if !waitUntil(ctx, done) {
+			grpcServer.Stop()
+		}
+	})
 	return true
 }
 
+// grpcPeerAddr returns address of the client that made the gRPC call
+func grpcPeerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
 // PLogCollectorServiceServer is gRPC server to handle log request
 type PLogCollectorServiceServer struct {
 }
@@ -52,18 +96,35 @@ func (server *PLogCollectorServiceServer) Ping(context.Context, *empty.Empty) (*
 }
 
 // Ping implements PLogCollectorServiceServer.Log
-func (server *PLogCollectorServiceServer) Log(_ context.Context, msg *pb.PLogMessage) (*pb.PLogResult, error) {
+func (server *PLogCollectorServiceServer) Log(ctx context.Context, msg *pb.PLogMessage) (*pb.PLogResult, error) {
+	key, err := grpcApiKey(ctx)
+	if err != nil {
+		return nil, err
+	}
 	category := strings.TrimSpace(msg.Category)
 	message := strings.TrimSpace(msg.Message)
 	if category == "" || message == "" {
+		countGatewayRejected(gatewayGrpc)
 		return &pb.PLogResult{
 			Status:     400,
 			NumSuccess: 0,
 			Message:    "Missing parameter [category] and/or [message]",
 		}, nil
 	}
-	payload := strings.ToLower(category) + logger.SeparatorTsv + message
-	if err := handleIncomingMessage([]byte(payload), true); err != nil {
+	entry := newLogEntry(category, message, gatewayGrpc, grpcPeerAddr(ctx))
+	if msg.Timestamp > 0 {
+		entry.Timestamp = time.Unix(0, msg.Timestamp*int64(time.Millisecond))
+	}
+	if len(msg.Fields) > 0 {
+		entry.Fields = msg.Fields
+	}
+	if err := authorize(key, entry); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err := handleIncomingMessage(entry, true); err != nil {
+		if code := grpcErrorCode(err); code != codes.OK {
+			return nil, status.Error(code, err.Error())
+		}
 		return &pb.PLogResult{
 			Status:     500,
 			NumSuccess: 0,
@@ -77,8 +138,28 @@ func (server *PLogCollectorServiceServer) Log(_ context.Context, msg *pb.PLogMes
 	}, nil
 }
 
+// grpcErrorCode returns the gRPC status code of a failure to handle an incoming log entry: RESOURCE_EXHAUSTED if buffer
+// is full, UNAVAILABLE if the application is shutting down, circuit breaker of a delivery=sync category is open or no
+// write slot is free for a delivery=sync log entry,
+// DEADLINE_EXCEEDED if writing a delivery=sync log entry timed out, or OK for other errors (reported in PLogResult)
+func grpcErrorCode(err error) codes.Code {
+	switch err {
+	case errBufferFull:
+		return codes.ResourceExhausted
+	case errShuttingDown, errBreakerOpen, errNoWriteSlot:
+		return codes.Unavailable
+	case errSyncTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.OK
+}
+
 // Ping implements PLogCollectorServiceServer.LogStream
 func (server *PLogCollectorServiceServer) LogStream(msgs pb.PLogCollectorService_LogStreamServer) error {
+	key, err := grpcApiKey(msgs.Context())
+	if err != nil {
+		return err
+	}
 	result := &pb.PLogResult{
 		NumSuccess: 0,
 	}
@@ -97,12 +178,25 @@ func (server *PLogCollectorServiceServer) LogStream(msgs pb.PLogCollectorService
 		category := strings.TrimSpace(msg.Category)
 		message := strings.TrimSpace(msg.Message)
 		if category == "" || message == "" {
+			countGatewayRejected(gatewayGrpc)
 			result.Status = 400
 			result.Message = "Missing parameter [category] and/or [message]"
 			return msgs.SendAndClose(result)
 		}
-		payload := strings.ToLower(category) + logger.SeparatorTsv + message
-		if err := handleIncomingMessage([]byte(payload), true); err != nil {
+		entry := newLogEntry(category, message, gatewayGrpc, grpcPeerAddr(msgs.Context()))
+		if msg.Timestamp > 0 {
+			entry.Timestamp = time.Unix(0, msg.Timestamp*int64(time.Millisecond))
+		}
+		if len(msg.Fields) > 0 {
+			entry.Fields = msg.Fields
+		}
+		if err := authorize(key, entry); err != nil {
+			return status.Error(codes.PermissionDenied, fmt.Sprintf("%s (%d entries accepted)", err.Error(), result.NumSuccess))
+		}
+		if err := handleIncomingMessage(entry, true); err != nil {
+			if code := grpcErrorCode(err); code != codes.OK {
+				return status.Error(code, fmt.Sprintf("%s (%d entries accepted)", err.Error(), result.NumSuccess))
+			}
 			result.Status = 500
 			result.Message = err.Error()
 			return msgs.SendAndClose(result)
@@ -0,0 +1,158 @@
+package prista
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"main/src/utils"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	grpcServiceName           = "PLogCollectorService"
+	defaultGrpcHealthInterval = 5 * time.Second
+	defaultBufferFailureTtl   = 30 * time.Second
+)
+
+var (
+	bufferHealthLock    sync.Mutex
+	bufferQueueFailedAt time.Time // time the last attempt to put a log entry to buffer failed, zero if it succeeded
+
+	writerHealthLock   sync.Mutex
+	writerFailingSince = make(map[string]time.Time) // categories whose log writers are failing, and since when
+)
+
+// recordBufferQueue records result of putting a log entry to buffer
+func recordBufferQueue(err error) {
+	bufferHealthLock.Lock()
+	defer bufferHealthLock.Unlock()
+	if err != nil {
+		bufferQueueFailedAt = time.Now()
+	} else {
+		bufferQueueFailedAt = time.Time{}
+	}
+}
+
+// isBufferQueueFailing returns true if putting a log entry to buffer failed within [server.health.buffer_failure_ttl].
+// The failure expires after that, so that an instance taken out of rotation (hence receiving no log entry to prove the
+// buffer has recovered) becomes ready again.
+func isBufferQueueFailing(now time.Time) bool {
+	bufferHealthLock.Lock()
+	failedAt := bufferQueueFailedAt
+	bufferHealthLock.Unlock()
+	ttl := AppConfig.GetTimeDuration("server.health.buffer_failure_ttl", defaultBufferFailureTtl)
+	return !failedAt.IsZero() && now.Sub(failedAt) < ttl
+}
+
+// recordWrite records result of writing a log entry to a category
+func recordWrite(cat string, err error) {
+	writerHealthLock.Lock()
+	defer writerHealthLock.Unlock()
+	if err == nil {
+		delete(writerFailingSince, cat)
+	} else if _, ok := writerFailingSince[cat]; !ok {
+		writerFailingSince[cat] = time.Now()
+	}
+}
+
+// criticalCategories returns categories configured at [server.health.critical_categories]
+func criticalCategories() []string {
+	result := make([]string, 0)
+	if conf := AppConfig.GetValue("server.health.critical_categories"); conf != nil && !conf.IsEmpty() {
+		if list, ok := utils.UnwrapHocon(conf).([]interface{}); ok {
+			for _, item := range list {
+				if item != nil {
+					if cat := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", item))); cat != "" {
+						result = append(result, cat)
+					}
+				}
+			}
+		}
+	}
+	return result
+}
+
+// checkReadiness returns reasons why the application is not ready to receive log entries (empty if it is ready):
+//	- application is shutting down
+//	- buffer is not writable (putting a log entry to buffer failed within [server.health.buffer_failure_ttl])
+//	- buffer is full (see [buffer.max_entries] and [buffer.max_bytes])
+//	- number of messages waiting in buffer exceeds [server.health.max_backlog]
+//	- log writer of a critical category (configured at [server.health.critical_categories]) has been failing for longer than its retry_seconds
+func checkReadiness() []string {
+	reasons := make([]string, 0)
+	if isShuttingDown() {
+		return append(reasons, "application is shutting down")
+	}
+	now := time.Now()
+	if queueSize, err := bufferBacklog(); err != nil {
+		reasons = append(reasons, "buffer is not available: "+err.Error())
+	} else if isBufferQueueFailing(now) {
+		reasons = append(reasons, "buffer is not writable")
+	} else if bb, ok := Buffer.(*boundedBuffer); ok && bb.isFull() {
+		reasons = append(reasons, "buffer is full")
+	} else if maxBacklog := AppConfig.GetInt64("server.health.max_backlog", 0); maxBacklog > 0 && queueSize > maxBacklog {
+		reasons = append(reasons, fmt.Sprintf("buffer backlog exceeds threshold (%d > %d)", queueSize, maxBacklog))
+	}
+	for _, cat := range criticalCategories() {
+		logWritersLock.RLock()
+		lwi := LogWriters[cat]
+		logWritersLock.RUnlock()
+		writerHealthLock.Lock()
+		since, failing := writerFailingSince[cat]
+		writerHealthLock.Unlock()
+		if lwi == nil || !failing || lwi.RetrySeconds < 0 {
+			// writers that retry forever never fail for longer than their retry_seconds
+			continue
+		}
+		if failedFor := now.Sub(since); failedFor > time.Duration(lwi.RetrySeconds)*time.Second {
+			reasons = append(reasons, fmt.Sprintf("log writer for category [%s] has been failing for %s", cat, failedFor.Truncate(time.Second)))
+		}
+	}
+	return reasons
+}
+
+// bufferBacklog returns number of messages waiting in buffer, read from counters of bounded buffer
+func bufferBacklog() (int64, error) {
+	if bb, ok := Buffer.(*boundedBuffer); ok {
+		queued, _ := bb.sizes()
+		return queued, nil
+	}
+	queueSize, err := Buffer.QueueSize()
+	return int64(queueSize), err
+}
+
+// httpHandlerHealthz handles liveness check: the application is alive as long as it can serve the request
+func httpHandlerHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{"status": 200, "message": "Ok"})
+}
+
+// httpHandlerReadyz handles readiness check, responding "503 Service Unavailable" if the application is not ready to receive log entries
+func httpHandlerReadyz(c echo.Context) error {
+	if reasons := checkReadiness(); len(reasons) > 0 {
+		return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{"status": 503, "message": strings.Join(reasons, "; ")})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"status": 200, "message": "Ok"})
+}
+
+// goUpdateGrpcHealth periodically updates serving status of the standard gRPC health service according to readiness check
+func goUpdateGrpcHealth(healthServer *health.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status := healthpb.HealthCheckResponse_SERVING
+		if len(checkReadiness()) > 0 {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		healthServer.SetServingStatus("", status)
+		healthServer.SetServingStatus(grpcServiceName, status)
+		select {
+		case <-shuttingDown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package prista
+
+import (
+	"errors"
+	"github.com/btnguyen2k/singu"
+	"github.com/go-akka/configuration"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessBufferRecovery(t *testing.T) {
+	defer func(conf *configuration.Config) { AppConfig = conf }(AppConfig)
+	defer func(buffer singu.IQueue) { Buffer = buffer }(Buffer)
+	defer recordBufferQueue(nil)
+	AppConfig = configuration.ParseString(`server.health.buffer_failure_ttl = 1m`)
+	Buffer = newTestBoundedBuffer(t, false, ``)
+	errQueue := errors.New("disk is full")
+	testCases := []struct {
+		name  string
+		queue func() // results of putting log entries to buffer
+		ready bool
+	}{
+		{"no failure", func() {}, true},
+		{"recent failure", func() { recordBufferQueue(errQueue) }, false},
+		{"failure followed by success", func() { recordBufferQueue(errQueue); recordBufferQueue(nil) }, true},
+		{"success followed by failure", func() { recordBufferQueue(nil); recordBufferQueue(errQueue) }, false},
+		{"expired failure", func() {
+			recordBufferQueue(errQueue)
+			bufferHealthLock.Lock()
+			bufferQueueFailedAt = bufferQueueFailedAt.Add(-2 * time.Minute)
+			bufferHealthLock.Unlock()
+		}, true},
+	}
+	for _, tc := range testCases {
+		recordBufferQueue(nil)
+		tc.queue()
+		reasons := checkReadiness()
+		if ready := len(reasons) == 0; ready != tc.ready {
+			t.Errorf("%s: expected ready=%v but received reasons [%s]", tc.name, tc.ready, strings.Join(reasons, "; "))
+		}
+	}
+}
@@ -1,12 +1,22 @@
 package prista
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"io/ioutil"
 	"log"
 	"main/src/logger"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,25 +37,163 @@ func initHttpServer(wg *sync.WaitGroup) bool {
 		e.Server.ReadTimeout = requestTimeout
 	}
 
+	// count rejected requests, including those rejected by other middlewares
+	e.Use(httpCountRejected)
+	var maxBodySize int64 = 0
 	bodyLimit := AppConfig.GetByteSize("server.max_request_size")
 	if bodyLimit != nil && bodyLimit.Int64() > 0 {
+		maxBodySize = bodyLimit.Int64()
 		e.Use(middleware.BodyLimit(bodyLimit.String()))
 	}
+	// body limit applies to both compressed and decompressed request body
+	e.Use(httpDecompress(maxBodySize))
 
-	e.POST("/api/log", httpHandlerLog)
-	e.PUT("/api/log", httpHandlerLog)
+	// log requests are authenticated by API keys if enabled (see auth.go)
+	e.POST("/api/log", httpHandlerLog, httpAuthenticate)
+	e.PUT("/api/log", httpHandlerLog, httpAuthenticate)
+	e.POST("/api/logs", httpHandlerLogs, httpAuthenticate)
+	e.GET("/healthz", httpHandlerHealthz)
+	e.GET("/readyz", httpHandlerReadyz)
+	if AppConfig.GetBoolean("server.http.admin_enabled", false) {
+		// admin API requires an admin API key, or a loopback client if authentication is disabled
+		admin := e.Group("/admin", httpAuthenticateAdmin)
+		admin.GET("/writers", httpHandlerAdminWriters)
+		registerDlqAdminApi(admin)
+		registerBufferAdminApi(admin)
+	}
+	if metricsPath := strings.TrimSpace(AppConfig.GetString("server.http.metrics_path", defaultMetricsPath)); metricsPath != "" {
+		e.GET(metricsPath, echo.WrapHandler(promhttp.Handler()))
+	}
 
-	log.Printf("Starting [%s] HTTP server on [%s:%d]...\n", AppConfig.GetString("app.name")+" v"+AppConfig.GetString("app.version"), listenAddr, listenPort)
+	tlsConfig, err := loadServerTlsConfig("server.http", "h2", "http/1.1")
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("Starting [%s] HTTP server on [%s:%d] (TLS: %t)...\n", AppConfig.GetString("app.name")+" v"+AppConfig.GetString("app.version"), listenAddr, listenPort, tlsConfig != nil)
 	go func() {
-		err := e.Start(fmt.Sprintf("%s:%d", listenAddr, listenPort))
-		if err != nil {
+		var err error
+		if tlsConfig != nil {
+			e.TLSServer.Addr = fmt.Sprintf("%s:%d", listenAddr, listenPort)
+			e.TLSServer.ReadTimeout = e.Server.ReadTimeout
+			e.TLSServer.TLSConfig = tlsConfig
+			err = e.StartServer(e.TLSServer)
+		} else {
+			err = e.Start(fmt.Sprintf("%s:%d", listenAddr, listenPort))
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Println(err)
 		}
 		wg.Done()
 	}()
+	onShutdown("HTTP server", func(ctx context.Context) {
+		// stop accepting new requests, wait for pending ones to complete
+		if err := e.Shutdown(ctx); err != nil {
+			log.Printf(fmt.Sprintf("WARN: error while shutting down HTTP server: %e", err))
+			e.Close()
+		}
+	})
 	return true
 }
 
+// httpCountRejected is a middleware that counts log requests rejected because of invalid request (400), request body
+// too large (413) or unsupported Content-Encoding (415). Failures to put entries to buffer are counted by handleIncomingMessage.
+func httpCountRejected(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if !strings.HasPrefix(c.Request().URL.Path, "/api/") {
+			return err
+		}
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		}
+		switch status {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+			countGatewayRejected(gatewayHttp)
+		}
+		return err
+	}
+}
+
+// strictLimitedReader reads at most limit bytes from the underlying reader, and fails with "413 - Request Entity Too Large" if there are more
+type strictLimitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (r *strictLimitedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		// limit reached, probe if there is more data
+		var probe [1]byte
+		if n, err := r.r.Read(probe[:]); n > 0 {
+			return 0, echo.ErrStatusRequestEntityTooLarge
+		} else {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// httpDecompress returns a middleware that decompresses request body sent with header "Content-Encoding: gzip" or "Content-Encoding: zstd".
+// If maxBodySize is positive, decompressed request body larger than maxBodySize is rejected.
+func httpDecompress(maxBodySize int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			var body io.ReadCloser
+			switch encoding := strings.ToLower(strings.TrimSpace(req.Header.Get(echo.HeaderContentEncoding))); encoding {
+			case "", "identity":
+				return next(c)
+			case "gzip":
+				if r, err := gzip.NewReader(req.Body); err != nil {
+					return c.HTML(http.StatusBadRequest, "Invalid gzip request body: "+err.Error())
+				} else {
+					body = r
+				}
+			case "zstd":
+				if r, err := zstd.NewReader(req.Body); err != nil {
+					return c.HTML(http.StatusBadRequest, "Invalid zstd request body: "+err.Error())
+				} else {
+					body = r.IOReadCloser()
+				}
+			default:
+				return c.HTML(http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported Content-Encoding [%s]", encoding))
+			}
+			defer body.Close()
+			if maxBodySize > 0 {
+				req.Body = ioutil.NopCloser(&strictLimitedReader{r: body, remaining: maxBodySize})
+			} else {
+				req.Body = body
+			}
+			// size of decompressed body is unknown
+			req.ContentLength = -1
+			req.Header.Del(echo.HeaderContentEncoding)
+			req.Header.Del(echo.HeaderContentLength)
+			return next(c)
+		}
+	}
+}
+
+// isBodyTooLarge checks if the error occurred while reading request body is caused by the body exceeding max_request_size
+func isBodyTooLarge(err error) bool {
+	for err != nil {
+		he, ok := err.(*echo.HTTPError)
+		if !ok {
+			return false
+		}
+		if he.Code == http.StatusRequestEntityTooLarge {
+			return true
+		}
+		err = he.Internal
+	}
+	return false
+}
+
 func extractString(source map[string]interface{}, keys ...string) string {
 	for _, key := range keys {
 		if v, ok := source[key]; ok {
@@ -58,20 +206,172 @@ func extractString(source map[string]interface{}, keys ...string) string {
 	return ""
 }
 
+// extractFields extracts extra fields (a JSON object of string values) of a log entry
+func extractFields(source map[string]interface{}, key string) map[string]string {
+	if v, ok := source[key].(map[string]interface{}); ok && len(v) > 0 {
+		fields := make(map[string]string, len(v))
+		for fk, fv := range v {
+			switch fv.(type) {
+			case string:
+				fields[fk] = fv.(string)
+			case nil:
+			default:
+				fields[fk] = fmt.Sprintf("%v", fv)
+			}
+		}
+		return fields
+	}
+	return nil
+}
+
+// parseJsonLogEntry builds a log entry from JSON data {"category":..., "message":..., "timestamp":..., "fields":{...}} submitted via a gateway
+func parseJsonLogEntry(data map[string]interface{}, gateway, source string) (*logger.LogEntry, error) {
+	category := extractString(data, "category", "cat", "c")
+	message := extractString(data, "message", "msg", "m")
+	if category == "" || message == "" {
+		return nil, errors.New("Missing parameter [category] and/or [message]")
+	}
+	entry := newLogEntry(category, message, gateway, source)
+	entry.Fields = extractFields(data, "fields")
+	if v, ok := data["timestamp"]; ok && v != nil {
+		if timestamp, err := parseTimestamp(v); err != nil {
+			return nil, errors.New("Invalid parameter [timestamp]: " + err.Error())
+		} else {
+			entry.Timestamp = timestamp
+		}
+	}
+	return entry, nil
+}
+
 func httpHandlerLog(c echo.Context) error {
 	requestBodyData := map[string]interface{}{}
 	if err := c.Bind(&requestBodyData); err != nil {
+		if isBodyTooLarge(err) {
+			return c.HTML(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		}
 		log.Printf(fmt.Sprintf("Error while parsing request body as Json: %e", err))
 		return c.HTML(http.StatusBadRequest, err.Error())
 	}
-	category := extractString(requestBodyData, "category", "cat", "c")
-	message := extractString(requestBodyData, "message", "msg", "m")
-	if category == "" || message == "" {
-		return c.HTML(http.StatusBadRequest, "Missing parameter [category] and/or [message]")
+	entry, err := parseJsonLogEntry(requestBodyData, gatewayHttp, c.RealIP())
+	if err != nil {
+		return c.HTML(http.StatusBadRequest, err.Error())
 	}
-	payload := strings.ToLower(category) + logger.SeparatorTsv + message
-	if err := handleIncomingMessage([]byte(payload), true); err != nil {
-		return c.HTML(http.StatusInternalServerError, err.Error())
+	if err := authorize(httpApiKey(c), entry); err != nil {
+		return c.HTML(http.StatusForbidden, err.Error())
+	}
+	if err := handleIncomingMessage(entry, true); err != nil {
+		return c.HTML(httpIncomingErrorStatus(c, err), err.Error())
 	}
 	return c.JSON(http.StatusOK, map[string]interface{}{"status": 200, "message": "Ok"})
 }
+
+// httpIncomingErrorStatus returns HTTP status of a failure to handle an incoming log entry: 429 if buffer is full,
+// 503 if the application is shutting down, circuit breaker of a delivery=sync category is open or no write slot is free
+// for a delivery=sync log entry (all with header "Retry-After"), 504 if writing a delivery=sync log entry timed out, or 500 for other errors (e.g. the log writer's error)
+func httpIncomingErrorStatus(c echo.Context, err error) int {
+	status := http.StatusInternalServerError
+	switch err {
+	case errBufferFull:
+		status = http.StatusTooManyRequests
+	case errShuttingDown, errBreakerOpen, errNoWriteSlot:
+		status = http.StatusServiceUnavailable
+	case errSyncTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return status
+	}
+	retryAfter := defaultRetryAfter
+	if bb, ok := Buffer.(*boundedBuffer); ok {
+		retryAfter = bb.retryAfter
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	return status
+}
+
+const mimeNdjson = "application/x-ndjson"
+
+// parseHttpBatch parses a batch of log entries, either a JSON array of objects or newline-delimited JSON objects (NDJSON)
+func parseHttpBatch(body []byte, ndjson bool) ([]interface{}, error) {
+	if !ndjson {
+		items := make([]interface{}, 0)
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+	items := make([]interface{}, 0)
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var item interface{}
+		if err := json.Unmarshal(line, &item); err != nil {
+			// keep the error so that it is reported as result of this entry
+			item = err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// httpHandlerLogs handles a batch of log entries.
+// Response: {"status":<200 if all entries succeeded, otherwise status of the first failed entry>, "numSuccess":<number of successfully logged entries>, "message":..., "results":[{"status":..., "message":...}, ...]}
+func httpHandlerLogs(c echo.Context) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			return c.HTML(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		}
+		return c.HTML(http.StatusBadRequest, err.Error())
+	}
+	ndjson := strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), mimeNdjson)
+	items, err := parseHttpBatch(body, ndjson)
+	if err != nil {
+		log.Printf(fmt.Sprintf("Error while parsing request body as batch of log entries: %e", err))
+		return c.HTML(http.StatusBadRequest, err.Error())
+	}
+	if len(items) == 0 {
+		return c.HTML(http.StatusBadRequest, "Empty batch")
+	}
+
+	status, numSuccess, message := 200, 0, "Ok"
+	results := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		itemStatus, itemMessage := 200, "Ok"
+		if data, ok := item.(map[string]interface{}); !ok {
+			itemStatus, itemMessage = 400, fmt.Sprintf("Invalid log entry: %v", item)
+			countGatewayRejected(gatewayHttp)
+		} else if entry, err := parseJsonLogEntry(data, gatewayHttp, c.RealIP()); err != nil {
+			itemStatus, itemMessage = 400, err.Error()
+			countGatewayRejected(gatewayHttp)
+		} else if err := authorize(httpApiKey(c), entry); err != nil {
+			itemStatus, itemMessage = 403, err.Error()
+		} else if err := handleIncomingMessage(entry, true); err != nil {
+			itemStatus, itemMessage = httpIncomingErrorStatus(c, err), err.Error()
+		} else {
+			numSuccess++
+		}
+		if itemStatus != 200 && status == 200 {
+			status, message = itemStatus, fmt.Sprintf("Entry #%d: %s", i, itemMessage)
+		}
+		results[i] = map[string]interface{}{"status": itemStatus, "message": itemMessage}
+	}
+	httpStatus := http.StatusOK
+	if numSuccess == 0 && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) {
+		// no entry of the batch was accepted, clients should back off and retry the whole batch
+		httpStatus = status
+	}
+	return c.JSON(httpStatus, map[string]interface{}{"status": status, "numSuccess": numSuccess, "message": message, "results": results})
+}
+
+// httpHandlerAdminWriters returns info of log writers per category, including state of their circuit breakers
+func httpHandlerAdminWriters(c echo.Context) error {
+	logWritersLock.RLock()
+	defer logWritersLock.RUnlock()
+	writers := make(map[string]interface{})
+	for cat, lwi := range LogWriters {
+		writers[cat] = lwi.Info()
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"status": 200, "message": "Ok", "data": writers})
+}
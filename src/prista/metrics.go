@@ -0,0 +1,166 @@
+package prista
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"main/src/logger"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMetricsPath = "/metrics"
+
+// Prometheus metrics, exposed via HTTP gateway at [server.http.metrics_path].
+// Per-category metrics are labeled by the category of the log writer handling the entries (categories without their own
+// log writer are counted to "default"), so that clients can not blow up number of time series by sending arbitrary categories.
+var (
+	metricGatewayReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_gateway_received_total",
+		Help: "Number of log entries received via gateways and put to buffer (or written, for delivery=sync categories).",
+	}, []string{"gateway"})
+	metricGatewayRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_gateway_rejected_total",
+		Help: "Number of log entries rejected by gateways (invalid, too large, failed to be put to buffer or, for delivery=sync categories, to be written).",
+	}, []string{"gateway"})
+
+	metricAuth = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_api_key_entries_total",
+		Help: "Number of log entries (or requests, for those failing to authenticate) by API key and result of authentication: accepted, unauthenticated or forbidden.",
+	}, []string{"key", "result"})
+
+	metricLogWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_log_written_total",
+		Help: "Number of log entries successfully written.",
+	}, []string{"category"})
+	metricLogFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_log_failed_total",
+		Help: "Number of failed attempts to write log entries.",
+	}, []string{"category"})
+	metricLogRetried = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_log_retried_total",
+		Help: "Number of failed log entries put back to buffer to be retried.",
+	}, []string{"category"})
+	metricLogDiscarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_log_discarded_total",
+		Help: "Number of log entries discarded (undecodable, no log writer, or still failing after retry_seconds).",
+	}, []string{"category"})
+	metricDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_log_dead_lettered_total",
+		Help: "Number of discarded log entries moved to dead-letter storage.",
+	}, []string{"category"})
+	metricWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prista_write_duration_seconds",
+		Help:    "Latency of writing log entries, by log writer type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"writer_type"})
+	metricWritesPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prista_writes_pending",
+		Help: "Number of log entries taken from buffer and waiting for a write slot.",
+	}, []string{"category"})
+	metricWritesInProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prista_writes_in_progress",
+		Help: "Number of log entries being written (write slots in use).",
+	}, []string{"category"})
+	metricBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prista_circuit_breaker_open",
+		Help: "1 if circuit breaker of the log writer is open (or half-open), 0 if closed.",
+	}, []string{"category"})
+
+	metricOrphanMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "prista_buffer_orphan_messages",
+		Help: "Number of orphan messages (taken from buffer but neither finished nor requeued) found at the last check.",
+	})
+	metricOrphanRequeued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "prista_buffer_orphan_requeued_total",
+		Help: "Number of orphan messages put back to buffer.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prista_buffer_queue_size",
+		Help: "Number of messages waiting in buffer.",
+	}, func() float64 {
+		return bufferSize(false, func() (int, error) { return Buffer.QueueSize() })
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prista_buffer_ephemeral_size",
+		Help: "Number of messages taken from buffer and being written.",
+	}, func() float64 {
+		return bufferSize(true, func() (int, error) { return Buffer.EphemeralSize() })
+	})
+	metricBufferDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_buffer_dropped_total",
+		Help: "Number of buffered log entries dropped to make room for incoming ones (overflow policy drop_oldest, drop_category_oldest or drop_priority).",
+	}, []string{"category"})
+	metricBufferRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prista_buffer_rejected_total",
+		Help: "Number of incoming log entries rejected because buffer is full.",
+	}, []string{"gateway"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prista_buffer_entries",
+		Help: "Number of log entries in buffer (waiting or being written), counted towards buffer.max_entries.",
+	}, func() float64 {
+		entries, _ := bufferUsage()
+		return entries
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prista_buffer_bytes",
+		Help: "Payload size of log entries in buffer (waiting or being written), counted towards buffer.max_bytes.",
+	}, func() float64 {
+		_, bytes := bufferUsage()
+		return bytes
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prista_concurrent_writes",
+		Help: "Number of log entries being put to buffer by gateways, used to throttle [buffer->log-writer] rate.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&ConcurrentWrite))
+	})
+)
+
+// bufferSize returns size of buffer's queue (or ephemeral) storage, or -1 if size is not available. Sizes of bounded
+// buffer are read from its counters, f is called only for other buffers.
+func bufferSize(ephemeral bool, f func() (int, error)) float64 {
+	if Buffer == nil || isBufferClosed() {
+		return -1
+	}
+	if bb, ok := Buffer.(*boundedBuffer); ok {
+		queued, taken := bb.sizes()
+		if ephemeral {
+			return float64(taken)
+		}
+		return float64(queued)
+	}
+	if size, err := f(); err == nil && size >= 0 {
+		return float64(size)
+	}
+	return -1
+}
+
+// bufferUsage returns number and payload size of log entries in buffer, or -1 if not available
+func bufferUsage() (float64, float64) {
+	if bb, ok := Buffer.(*boundedBuffer); ok && !isBufferClosed() {
+		entries, bytes := bb.usage()
+		return float64(entries), float64(bytes)
+	}
+	return -1, -1
+}
+
+// countAuth counts result of authenticating a log entry with an API key (empty key name if authentication failed)
+func countAuth(key, result string) {
+	metricAuth.WithLabelValues(key, result).Inc()
+}
+
+func countGatewayRejected(gateway string) {
+	metricGatewayRejected.WithLabelValues(gateway).Inc()
+}
+
+func setBreakerState(cat, state string) {
+	if state == logger.BreakerClosed {
+		metricBreakerOpen.WithLabelValues(cat).Set(0)
+	} else {
+		metricBreakerOpen.WithLabelValues(cat).Set(1)
+	}
+}
+
+func observeWriteDuration(writerType string, start time.Time) {
+	metricWriteDuration.WithLabelValues(writerType).Observe(time.Since(start).Seconds())
+}
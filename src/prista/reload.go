@@ -0,0 +1,278 @@
+package prista
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btnguyen2k/consu/reddo"
+	"github.com/btnguyen2k/consu/semita"
+	"github.com/go-akka/configuration"
+	"log"
+	"main/src/logger"
+	"main/src/utils"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultConfigWatchInterval = 5 * time.Second
+
+var (
+	appConfigFile  string                            // the main configuration file
+	logWritersLock sync.RWMutex                      // protects LogWriters and logWriterConfs
+	logWriterConfs map[string]map[string]interface{} // configurations of log writers currently in use, keyed by category
+	reloadLock     sync.Mutex                        // only one reload at a time
+	retiringWg     sync.WaitGroup                    // retired log writers waiting for their in-flight writes before being destroyed
+)
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampFiles(files []string) map[string]fileStamp {
+	result := make(map[string]fileStamp)
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			result[f] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		} else {
+			result[f] = fileStamp{}
+		}
+	}
+	return result
+}
+
+// logWriterConfigs extracts configurations of log writers from the "log" block, keyed by (lower-cased) category name
+func logWriterConfigs(config *configuration.Config) (map[string]map[string]interface{}, error) {
+	if config == nil || !config.Root().IsObject() {
+		return nil, errors.New("no valid log writer configured")
+	}
+	result := make(map[string]map[string]interface{})
+	for cat, conf := range config.Root().GetObject().Items() {
+		if conf == nil || !conf.IsObject() {
+			return nil, errors.New(fmt.Sprintf("invalid config for log writer [%s]: %v", cat, conf))
+		}
+		confMap := utils.UnwrapHocon(conf).(map[string]interface{})
+		if _, err := logger.ParseRetryBackoff(confMap); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid config for log writer [%s]: %s", cat, err))
+		}
+		if _, err := logger.ParseCircuitBreaker(confMap); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid config for log writer [%s]: %s", cat, err))
+		}
+		if _, err := logger.ParseConcurrency(confMap); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid config for log writer [%s]: %s", cat, err))
+		}
+		if _, err := logger.ParsePriority(confMap); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid config for log writer [%s]: %s", cat, err))
+		}
+		if _, err := logger.ParseDelivery(confMap); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid config for log writer [%s]: %s", cat, err))
+		}
+		result[strings.ToLower(cat)] = confMap
+	}
+	if _, ok := result["default"]; !ok {
+		return nil, errors.New("no valid log writer for 'default' category")
+	}
+	return result, nil
+}
+
+// newLogWriterAndInfo wraps a log writer with its info, conf is the log writer configurations (already validated by logWriterConfigs)
+func newLogWriterAndInfo(writer logger.ILogWriter, conf map[string]interface{}) *logger.LogWriterAndInfo {
+	info := semita.NewSemita(writer.Info())
+	retrySeconds, err := info.GetValueOfType(logger.ConfRetrySeconds, reddo.TypeInt)
+	if err != nil || retrySeconds == nil {
+		retrySeconds = int64(logger.DefaultRetrySeconds)
+	}
+	writerType, _ := info.GetValueOfType("name", reddo.TypeString)
+	if writerType == nil {
+		writerType = ""
+	}
+	backoff, _ := logger.ParseRetryBackoff(conf)
+	breaker, _ := logger.ParseCircuitBreaker(conf)
+	concurrency, _ := logger.ParseConcurrency(conf)
+	priority, _ := logger.ParsePriority(conf)
+	delivery, _ := logger.ParseDelivery(conf)
+	return &logger.LogWriterAndInfo{LogWriter: writer, Type: writerType.(string), RetrySeconds: retrySeconds.(int64),
+		RetryBackoff: backoff, Breaker: breaker, Concurrency: concurrency, Priority: priority, Delivery: delivery,
+		InFlight: &sync.WaitGroup{}}
+}
+
+// reloadLogWriters applies new log writer configurations: unchanged writers are kept, changed writers are refreshed (or
+// re-created if writer type changes), writers of new categories are created and writers of removed categories are destroyed.
+//
+// Either all changes are applied, or none of them: if any writer fails to apply its new configurations, the already
+// refreshed writers are reverted and the newly created ones are destroyed.
+func reloadLogWriters(config *configuration.Config) (err error) {
+	newConfs, err := logWriterConfigs(config)
+	if err != nil {
+		return err
+	}
+	logWritersLock.RLock()
+	current, currentConfs := LogWriters, logWriterConfs
+	logWritersLock.RUnlock()
+
+	result := make(map[string]*logger.LogWriterAndInfo)
+	created := make([]logger.ILogWriter, 0)
+	refreshed := make([]string, 0)
+	retired := make([]*logger.LogWriterAndInfo, 0)
+	rollback := func() {
+		for _, writer := range created {
+			writer.Destroy()
+		}
+		for _, cat := range refreshed {
+			if err := logger.RefreshLogWriter(current[cat].LogWriter, currentConfs[cat]); err != nil {
+				log.Printf("ERROR: error reverting log writer for category [%s]: %e", cat, err)
+			}
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			rollback()
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+	}()
+	for cat, conf := range newConfs {
+		lwi, exists := current[cat]
+		switch {
+		case exists && reflect.DeepEqual(conf, currentConfs[cat]):
+			result[cat] = lwi
+		case exists && conf["type"] == currentConfs[cat]["type"]:
+			// a writer failing to refresh may have been partly refreshed, it is reverted as well
+			refreshed = append(refreshed, cat)
+			if err := logger.RefreshLogWriter(lwi.LogWriter, conf); err != nil {
+				rollback()
+				return errors.New(fmt.Sprintf("error refreshing log writer for category [%s]: %s", cat, err))
+			}
+			result[cat] = newLogWriterAndInfo(lwi.LogWriter, conf)
+			// writes in progress with the old info are writes of the same writer
+			result[cat].InFlight = lwi.InFlight
+		default:
+			writer, err := logger.NewLogWriter(cat, conf, handleIncomingMessage)
+			if err != nil {
+				if writer != nil {
+					writer.Destroy()
+				}
+				rollback()
+				return errors.New(fmt.Sprintf("error creating log writer for category [%s]: %s", cat, err))
+			}
+			created = append(created, writer)
+			result[cat] = newLogWriterAndInfo(writer, conf)
+			if exists {
+				retired = append(retired, lwi)
+			}
+		}
+	}
+	for cat, lwi := range current {
+		if _, ok := newConfs[cat]; !ok {
+			retired = append(retired, lwi)
+		}
+	}
+
+	logWritersLock.Lock()
+	LogWriters, logWriterConfs = result, newConfs
+	logWritersLock.Unlock()
+	for cat, lwi := range result {
+		if current[cat] != lwi {
+			// refreshed or re-created writers start with a clean health record and a closed circuit breaker
+			recordWrite(cat, nil)
+			setBreakerState(cat, logger.BreakerClosed)
+		}
+	}
+	retireLogWriters(retired)
+	log.Printf("INFO: log writers reloaded: %d created, %d refreshed, %d destroyed", len(created), len(refreshed), len(retired))
+	return nil
+}
+
+// retireLogWriters destroys log writers no longer in use. Writes already holding a retired writer (see acquireLogWriter)
+// may still be in progress, so each writer is destroyed in background once its in-flight writes complete.
+// Caller must hold reloadLock.
+func retireLogWriters(retired []*logger.LogWriterAndInfo) {
+	for _, lwi := range retired {
+		retiringWg.Add(1)
+		go func(lwi *logger.LogWriterAndInfo) {
+			defer retiringWg.Done()
+			lwi.InFlight.Wait()
+			if err := lwi.LogWriter.Destroy(); err != nil {
+				log.Printf(fmt.Sprintf("WARN: error destroying log writer: %e", err))
+			}
+		}(lwi)
+	}
+}
+
+// tryLoadAppConfig loads configurations from file, returning error instead of panicking if configurations are invalid
+func tryLoadAppConfig(file string) (conf *configuration.Config, files []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			conf, err = nil, errors.New(fmt.Sprintf("%v", r))
+		}
+	}()
+	conf, files = loadAppConfigFiles(file)
+	return conf, files, nil
+}
+
+// configWithoutLogBlock returns configurations, excluding the "log" block, in comparable form
+func configWithoutLogBlock(conf *configuration.Config) interface{} {
+	result := utils.UnwrapHocon(conf.Root())
+	if m, ok := result.(map[string]interface{}); ok {
+		delete(m, "log")
+	}
+	return result
+}
+
+// reloadConfig reloads configurations from file and applies changes to log writers.
+// Invalid configurations are rejected and the current ones are kept in use.
+// Returns the list of loaded configuration files.
+func reloadConfig() ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	conf, files, err := tryLoadAppConfig(appConfigFile)
+	if err != nil {
+		return nil, errors.New("invalid configurations: " + err.Error())
+	}
+	logConfig := conf.GetConfig("log")
+	if err := reloadLogWriters(logConfig); err != nil {
+		return nil, err
+	}
+	LogConfig = logConfig
+	if !reflect.DeepEqual(configWithoutLogBlock(AppConfig), configWithoutLogBlock(conf)) {
+		log.Printf("WARN: configurations other than [log] block have changed, restart is required for them to take effect")
+	}
+	return files, nil
+}
+
+// goWatchConfig reloads configurations when configuration files change (checked every interval, 0 disables watching) or SIGHUP is received
+func goWatchConfig(files []string, interval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	stamps := stampFiles(files)
+	for {
+		select {
+		case <-signals:
+			log.Printf("INFO: SIGHUP received, reloading configurations...")
+		case <-tick:
+			if reflect.DeepEqual(stamps, stampFiles(files)) {
+				continue
+			}
+			log.Printf("INFO: configuration files changed, reloading configurations...")
+		}
+		// stamp files before reloading, so that invalid configurations are not reloaded again until files change
+		stamps = stampFiles(files)
+		if newFiles, err := reloadConfig(); err != nil {
+			log.Printf("ERROR: error reloading configurations, keep using current ones: %s", err)
+		} else {
+			log.Printf("INFO: configurations reloaded")
+			// included files may have changed
+			files, stamps = newFiles, stampFiles(newFiles)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package prista
+
+import (
+	"fmt"
+	"github.com/btnguyen2k/singu"
+	"log"
+	"main/src/logger"
+	"sync"
+	"time"
+)
+
+const (
+	// max number of log entries waiting in ephemeral storage for their next attempts, entries beyond this limit are put
+	// back to buffer after overflowRetryDelay (or at their next attempts if sooner)
+	maxDelayedRetries  = 100000
+	overflowRetryDelay = 1 * time.Second
+)
+
+// requeueForRetry puts a failed log entry, with its backoff state, back to buffer.
+// The entry is queued as a new message which keeps the original queue timestamp, so that retry_seconds is still counted
+// from the time the entry was first buffered.
+func requeueForRetry(buffer singu.IQueue, msg *singu.QueueMessage, entry *logger.LogEntry) error {
+	retryMsg := singu.NewQueueMessage(entry.Marshal())
+	retryMsg.Timestamp = msg.Timestamp
+	if _, err := buffer.Queue(retryMsg); err != nil {
+		// fallback: requeue the message as it is, without backoff state
+		_, err = buffer.Requeue(msg.Id, false)
+		return err
+	}
+	return buffer.Finish(msg.Id)
+}
+
+var (
+	delayedLock    sync.Mutex
+	delayedRetries = make(map[string]*time.Timer) // messages taken from buffer before their next attempts, waiting in ephemeral storage
+)
+
+// delayRetry keeps a message taken from buffer before its next attempt in ephemeral storage, and puts it back to buffer at
+// time of the next attempt (messages are put back to buffer after overflowRetryDelay if there are too many waiting messages,
+// so that they are not taken again right away).
+// Messages waiting in ephemeral storage when the application stops are requeued as orphan messages on next start.
+func delayRetry(buffer singu.IQueue, id string, at time.Time) {
+	requeue := func() {
+		delayedLock.Lock()
+		delete(delayedRetries, id)
+		delayedLock.Unlock()
+		if isBufferClosed() {
+			return
+		}
+		if _, err := buffer.Requeue(id, true); err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error requeueing message %s: %e", id, err))
+		}
+	}
+	delayedLock.Lock()
+	defer delayedLock.Unlock()
+	delay := time.Until(at)
+	if len(delayedRetries) >= maxDelayedRetries && delay > overflowRetryDelay {
+		delay = overflowRetryDelay
+	}
+	delayedRetries[id] = time.AfterFunc(delay, requeue)
+}
+
+// isDelayedRetry returns true if a message is waiting in ephemeral storage for its next attempt
+func isDelayedRetry(id string) bool {
+	delayedLock.Lock()
+	defer delayedLock.Unlock()
+	_, ok := delayedRetries[id]
+	return ok
+}
+
+// stopDelayedRetries stops putting waiting messages back to buffer, called when the application shuts down
+func stopDelayedRetries() {
+	delayedLock.Lock()
+	defer delayedLock.Unlock()
+	for id, timer := range delayedRetries {
+		timer.Stop()
+		delete(delayedRetries, id)
+	}
+}
@@ -0,0 +1,225 @@
+package prista
+
+import (
+	"github.com/btnguyen2k/singu"
+	"main/src/logger"
+	"sync"
+	"time"
+)
+
+// writeJob is a log entry taken from buffer, waiting for a write slot
+type writeJob struct {
+	msg   *singu.QueueMessage
+	entry *logger.LogEntry
+	cat   string // category of the log writer handling the entry
+}
+
+// categoryJobs holds pending writes of a category
+type categoryJobs struct {
+	jobs    []*writeJob
+	running int // number of writes in progress
+	limit   int // max number of concurrent writes (0 = no limit)
+	weight  int // number of slots the category receives in a round
+	credit  int // number of slots the category can still receive in the current round
+}
+
+// writeScheduler shares write slots (max_write_threads) among categories, so that a slow or noisy category can not starve others:
+//	- log entries taken from buffer wait in per-category pending lists
+//	- a category can not have more than its concurrency.max_threads writes in progress, categories without max_threads
+//	  get a fair share of max(1, max_write_threads / number of categories) slots
+//	- pending writes are dispatched in weighted round-robin order: in each round, a category receives up to concurrency.weight slots
+type writeScheduler struct {
+	maxThreads int
+	lock       sync.Mutex
+	running    int
+	pending    int
+	queues     map[string]*categoryJobs
+	order      []string // round-robin order of categories
+	cursor     int
+	scheduled  map[string]bool // ids of messages pending or being written
+	done       chan struct{}   // signaled when a write completes
+}
+
+// writeSched is the scheduler used by goWriteLogs
+var writeSched *writeScheduler
+
+func newWriteScheduler(maxThreads int) *writeScheduler {
+	if maxThreads < 1 {
+		maxThreads = 1
+	}
+	return &writeScheduler{
+		maxThreads: maxThreads,
+		queues:     make(map[string]*categoryJobs),
+		order:      make([]string, 0),
+		scheduled:  make(map[string]bool),
+		done:       make(chan struct{}, 1),
+	}
+}
+
+// hasRoom returns true if more log entries can be taken from buffer
+func (s *writeScheduler) hasRoom() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pending < 2*s.maxThreads
+}
+
+// fairShare resolves max_threads of a category: categories without max_threads (0) are limited to a fair share of write
+// slots, which is max(1, maxThreads / numCategories)
+func (s *writeScheduler) fairShare(concurrency logger.Concurrency, numCategories int) logger.Concurrency {
+	if concurrency.MaxThreads <= 0 {
+		concurrency.MaxThreads = 1
+		if numCategories > 0 && s.maxThreads/numCategories > 1 {
+			concurrency.MaxThreads = s.maxThreads / numCategories
+		}
+	}
+	return concurrency
+}
+
+// maxPending returns max number of pending jobs of a category
+func (s *writeScheduler) maxPending(concurrency logger.Concurrency) int {
+	if concurrency.MaxThreads > 0 && concurrency.MaxThreads < s.maxThreads {
+		return concurrency.MaxThreads
+	}
+	return s.maxThreads
+}
+
+// isFull returns true if a category already has enough pending jobs
+func (s *writeScheduler) isFull(cat string, concurrency logger.Concurrency) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.queues[cat]
+	return q != nil && len(q.jobs) >= s.maxPending(concurrency)
+}
+
+// numPending returns number of pending jobs of all categories
+func (s *writeScheduler) numPending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pending
+}
+
+// category returns pending jobs of a category, created if not exist. Caller must hold s.lock.
+func (s *writeScheduler) category(cat string) *categoryJobs {
+	q := s.queues[cat]
+	if q == nil {
+		q = &categoryJobs{jobs: make([]*writeJob, 0)}
+		s.queues[cat] = q
+		s.order = append(s.order, cat)
+	}
+	return q
+}
+
+// add puts a job to pending list of its category, returns false if the category already has too many pending jobs
+func (s *writeScheduler) add(job *writeJob, concurrency logger.Concurrency) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.category(job.cat)
+	q.limit, q.weight = concurrency.MaxThreads, concurrency.Weight
+	if q.weight < 1 {
+		q.weight = 1
+	}
+	if len(q.jobs) >= s.maxPending(concurrency) {
+		return false
+	}
+	q.jobs = append(q.jobs, job)
+	s.pending++
+	s.scheduled[job.msg.Id] = true
+	metricWritesPending.WithLabelValues(job.cat).Set(float64(len(q.jobs)))
+	return true
+}
+
+// dispatch starts pending jobs while there are free write slots
+func (s *writeScheduler) dispatch(start func(job *writeJob)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.running < s.maxThreads {
+		job := s.next()
+		if job == nil {
+			return
+		}
+		q := s.queues[job.cat]
+		q.running++
+		s.running++
+		s.pending--
+		metricWritesPending.WithLabelValues(job.cat).Set(float64(len(q.jobs)))
+		metricWritesInProgress.WithLabelValues(job.cat).Set(float64(q.running))
+		start(job)
+	}
+}
+
+// next picks the next job in weighted round-robin order, returns nil if no job can be started
+func (s *writeScheduler) next() *writeJob {
+	if len(s.order) == 0 {
+		return nil
+	}
+	// each category is visited at most twice: once to refill its credit, once more to take a job
+	for i := 0; i < 2*len(s.order); i++ {
+		q := s.queues[s.order[s.cursor]]
+		if len(q.jobs) > 0 && q.credit > 0 && (q.limit <= 0 || q.running < q.limit) {
+			q.credit--
+			job := q.jobs[0]
+			q.jobs[0] = nil
+			q.jobs = q.jobs[1:]
+			return job
+		}
+		// the category's turn is over, move to the next one
+		q.credit = q.weight
+		s.cursor = (s.cursor + 1) % len(s.order)
+	}
+	return nil
+}
+
+// tryAcquire takes a write slot for a write not scheduled from buffer (e.g. delivery=sync), returns false if all write
+// slots are in use, or the category already has max_threads writes in progress. The slot must be freed with releaseSlot.
+func (s *writeScheduler) tryAcquire(cat string, concurrency logger.Concurrency) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.category(cat)
+	if s.running >= s.maxThreads || (concurrency.MaxThreads > 0 && q.running >= concurrency.MaxThreads) {
+		return false
+	}
+	q.running++
+	s.running++
+	metricWritesInProgress.WithLabelValues(cat).Set(float64(q.running))
+	return true
+}
+
+// release frees the write slot of a completed job
+func (s *writeScheduler) release(job *writeJob) {
+	s.lock.Lock()
+	delete(s.scheduled, job.msg.Id)
+	s.lock.Unlock()
+	s.releaseSlot(job.cat)
+}
+
+// releaseSlot frees a write slot of a category
+func (s *writeScheduler) releaseSlot(cat string) {
+	s.lock.Lock()
+	q := s.queues[cat]
+	q.running--
+	s.running--
+	metricWritesInProgress.WithLabelValues(cat).Set(float64(q.running))
+	s.lock.Unlock()
+	select {
+	case s.done <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until a write completes, or timeout
+func (s *writeScheduler) wait(timeout time.Duration) {
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+}
+
+// isScheduled returns true if a message taken from buffer is pending or being written
+func (s *writeScheduler) isScheduled(id string) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.scheduled[id]
+}
@@ -0,0 +1,226 @@
+package prista
+
+import (
+	"fmt"
+	"github.com/btnguyen2k/singu"
+	"main/src/logger"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSchedulerDispatch(t *testing.T) {
+	type category struct {
+		name        string
+		numJobs     int
+		concurrency logger.Concurrency
+	}
+	testCases := []struct {
+		name       string
+		maxThreads int
+		categories []category
+		expected   string // categories of started jobs, in order
+	}{
+		{"equal weights", 10,
+			[]category{{"a", 3, logger.Concurrency{Weight: 1}}, {"b", 3, logger.Concurrency{Weight: 1}}},
+			"ababab"},
+		{"weighted", 10,
+			[]category{{"a", 3, logger.Concurrency{Weight: 2}}, {"b", 3, logger.Concurrency{Weight: 1}}},
+			"aababb"},
+		{"weight larger than pending jobs", 10,
+			[]category{{"a", 1, logger.Concurrency{Weight: 5}}, {"b", 2, logger.Concurrency{Weight: 1}}},
+			"abb"},
+		{"max_write_threads", 3,
+			[]category{{"a", 3, logger.Concurrency{Weight: 1}}, {"b", 3, logger.Concurrency{Weight: 1}}},
+			"aba"},
+		{"single category", 2,
+			[]category{{"a", 2, logger.Concurrency{Weight: 3}}},
+			"aa"},
+	}
+	for _, tc := range testCases {
+		sched := newWriteScheduler(tc.maxThreads)
+		id := 0
+		for _, cat := range tc.categories {
+			for i := 0; i < cat.numJobs; i++ {
+				id++
+				job := &writeJob{msg: &singu.QueueMessage{Id: fmt.Sprintf("%d", id)}, entry: &logger.LogEntry{Category: cat.name}, cat: cat.name}
+				if !sched.add(job, cat.concurrency) {
+					t.Fatalf("%s: job #%d of category [%s] rejected", tc.name, i, cat.name)
+				}
+			}
+		}
+		started := make([]string, 0)
+		sched.dispatch(func(job *writeJob) {
+			started = append(started, job.cat)
+		})
+		if result := strings.Join(started, ""); result != tc.expected {
+			t.Errorf("%s: expected %q but received %q", tc.name, tc.expected, result)
+		}
+	}
+}
+
+func TestWriteSchedulerRelease(t *testing.T) {
+	sched := newWriteScheduler(1)
+	concurrency := logger.Concurrency{Weight: 1}
+	for i, cat := range []string{"a", "b"} {
+		sched.add(&writeJob{msg: &singu.QueueMessage{Id: fmt.Sprintf("%d", i)}, entry: &logger.LogEntry{Category: cat}, cat: cat}, concurrency)
+	}
+	started := make([]*writeJob, 0)
+	start := func(job *writeJob) { started = append(started, job) }
+	sched.dispatch(start)
+	if len(started) != 1 || sched.numPending() != 1 || !sched.isScheduled(started[0].msg.Id) {
+		t.Fatalf("expected 1 started and 1 pending job but received %d started and %d pending", len(started), sched.numPending())
+	}
+	sched.dispatch(start)
+	if len(started) != 1 {
+		t.Fatalf("expected no job to start before a write slot is released, but %d jobs started", len(started))
+	}
+	sched.release(started[0])
+	if sched.isScheduled(started[0].msg.Id) {
+		t.Errorf("expected job %s no longer scheduled after being released", started[0].msg.Id)
+	}
+	sched.dispatch(start)
+	if len(started) != 2 || started[0].cat == started[1].cat || sched.numPending() != 0 {
+		t.Errorf("expected jobs of both categories started but received %d started and %d pending", len(started), sched.numPending())
+	}
+}
+
+func TestWriteSchedulerCategoryLimit(t *testing.T) {
+	sched := newWriteScheduler(10)
+	limited, unlimited := logger.Concurrency{MaxThreads: 1, Weight: 1}, logger.Concurrency{Weight: 1}
+	started := make([]string, 0)
+	start := func(job *writeJob) { started = append(started, job.cat) }
+	sched.add(&writeJob{msg: &singu.QueueMessage{Id: "a1"}, cat: "a"}, limited)
+	sched.dispatch(start)
+	// "a" already has max_threads writes in progress, its pending job must wait while "b" proceeds
+	sched.add(&writeJob{msg: &singu.QueueMessage{Id: "a2"}, cat: "a"}, limited)
+	sched.add(&writeJob{msg: &singu.QueueMessage{Id: "b1"}, cat: "b"}, unlimited)
+	sched.add(&writeJob{msg: &singu.QueueMessage{Id: "b2"}, cat: "b"}, unlimited)
+	sched.dispatch(start)
+	if result := strings.Join(started, ""); result != "abb" || sched.numPending() != 1 {
+		t.Errorf("expected %q started and 1 pending but received %q started and %d pending", "abb", result, sched.numPending())
+	}
+}
+
+func TestWriteSchedulerMaxPending(t *testing.T) {
+	sched := newWriteScheduler(4)
+	testCases := []struct {
+		concurrency logger.Concurrency
+		expected    int
+	}{
+		{logger.Concurrency{MaxThreads: 2, Weight: 1}, 2},
+		{logger.Concurrency{MaxThreads: 10, Weight: 1}, 4},
+	}
+	for i, tc := range testCases {
+		cat := fmt.Sprintf("cat%d", i)
+		added := 0
+		for sched.add(&writeJob{msg: &singu.QueueMessage{Id: fmt.Sprintf("%s-%d", cat, added)}, cat: cat}, tc.concurrency) {
+			added++
+		}
+		if added != tc.expected || !sched.isFull(cat, tc.concurrency) {
+			t.Errorf("max_threads=%d: expected %d pending jobs but received %d", tc.concurrency.MaxThreads, tc.expected, added)
+		}
+	}
+}
+
+func TestWriteSchedulerFairShare(t *testing.T) {
+	testCases := []struct {
+		name          string
+		maxThreads    int
+		maxThreadsCat int
+		numCategories int
+		expected      int
+	}{
+		{"fair share", 10, 0, 3, 3},
+		{"at least one slot", 10, 0, 20, 1},
+		{"single category", 10, 0, 1, 10},
+		{"no categories", 10, 0, 0, 1},
+		{"configured max_threads", 10, 5, 3, 5},
+		{"configured max_threads above fair share", 10, 8, 5, 8},
+	}
+	for _, tc := range testCases {
+		sched := newWriteScheduler(tc.maxThreads)
+		concurrency := sched.fairShare(logger.Concurrency{MaxThreads: tc.maxThreadsCat, Weight: 2}, tc.numCategories)
+		if concurrency.MaxThreads != tc.expected || concurrency.Weight != 2 {
+			t.Errorf("%s: expected max_threads=%d but received %d", tc.name, tc.expected, concurrency.MaxThreads)
+		}
+	}
+}
+
+func TestWriteSchedulerTryAcquire(t *testing.T) {
+	testCases := []struct {
+		name       string
+		maxThreads int
+		maxCat     int
+		attempts   int
+		expected   int // number of slots acquired
+	}{
+		{"free slots", 4, 0, 3, 3},
+		{"max_write_threads", 2, 0, 3, 2},
+		{"category max_threads", 4, 1, 3, 1},
+	}
+	for _, tc := range testCases {
+		sched := newWriteScheduler(tc.maxThreads)
+		concurrency := logger.Concurrency{MaxThreads: tc.maxCat, Weight: 1}
+		acquired := 0
+		for i := 0; i < tc.attempts; i++ {
+			if sched.tryAcquire("a", concurrency) {
+				acquired++
+			}
+		}
+		if acquired != tc.expected {
+			t.Errorf("%s: expected %d slots acquired but received %d", tc.name, tc.expected, acquired)
+		}
+		// a released slot can be acquired again
+		sched.releaseSlot("a")
+		if !sched.tryAcquire("a", concurrency) {
+			t.Errorf("%s: expected released slot to be acquired again", tc.name)
+		}
+	}
+}
+
+func TestTakeCategoriesUnconfigured(t *testing.T) {
+	defer func(lw map[string]*logger.LogWriterAndInfo) { LogWriters = lw }(LogWriters)
+	LogWriters = map[string]*logger.LogWriterAndInfo{"default": {}, "audit": {}}
+	testCases := []struct {
+		name     string
+		backlog  map[string]int // number of entries waiting in queue of each category
+		started  string         // writer categories of started jobs, sorted
+		pending  int
+		numTaken int
+	}{
+		// max_write_threads=4 shared by 2 writers: "default" gets 2 slots and 2 pending jobs
+		{"unconfigured category larger than default share", map[string]int{"foo": 10}, "default,default", 2, 4},
+		{"unconfigured category and configured one", map[string]int{"audit": 3, "foo": 10}, "audit,audit,default,default", 3, 7},
+		{"unconfigured categories sharing default writer", map[string]int{"bar": 10, "foo": 10}, "default,default", 2, 4},
+	}
+	for _, tc := range testCases {
+		buffer, _ := newCategoryBuffer(memoryBufferBackend, nil, "")
+		for cat, n := range tc.backlog {
+			// queues of categories without their own log writer, e.g. left from before a writer was removed
+			q, _ := buffer.queue(cat)
+			for i := 0; i < n; i++ {
+				q.Queue(singu.NewQueueMessage(newLogEntry(cat, fmt.Sprintf("%d", i), gatewayHttp, "").Marshal()))
+			}
+		}
+		sched := newWriteScheduler(4)
+		started := make([]string, 0)
+		done := make(chan int, 1)
+		go func() {
+			// jobs are started but never complete
+			numTaken, _ := takeCategories(buffer, buffer, sched, func(job *writeJob) { started = append(started, job.cat) })
+			done <- numTaken
+		}()
+		select {
+		case numTaken := <-done:
+			sort.Strings(started)
+			if result := strings.Join(started, ","); result != tc.started || sched.numPending() != tc.pending || numTaken != tc.numTaken {
+				t.Errorf("%s: expected [%s] started, %d pending and %d taken but received [%s], %d and %d",
+					tc.name, tc.started, tc.pending, tc.numTaken, result, sched.numPending(), numTaken)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: taking categories does not return", tc.name)
+		}
+	}
+}
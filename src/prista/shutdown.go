@@ -0,0 +1,163 @@
+package prista
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+var (
+	shuttingDown   = make(chan struct{}) // closed when the application starts shutting down
+	writeLogsDone  = make(chan struct{}) // closed when goWriteLogs stops taking messages from buffer
+	orphanLogsDone = make(chan struct{}) // closed when goProcessOrphanLogs stops requeueing orphan messages
+	writesWg       sync.WaitGroup        // in-flight writes (messages taken from buffer but not finished yet)
+	bufferClosed   int32                 // set to 1 when buffer is closed
+
+	shutdownHooksLock sync.Mutex
+	shutdownHooks     []shutdownHook
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context)
+}
+
+// onShutdown registers a function to be called to stop a component (e.g. a gateway) when the application shuts down.
+// The function should return as soon as possible once ctx is done.
+func onShutdown(name string, fn func(ctx context.Context)) {
+	shutdownHooksLock.Lock()
+	defer shutdownHooksLock.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// isShuttingDown returns true if the application is shutting down
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func isBufferClosed() bool {
+	return atomic.LoadInt32(&bufferClosed) != 0
+}
+
+// waitUntil waits for done to be closed or ctx to be done, returns false if ctx is done first
+func waitUntil(ctx context.Context, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// connSet tracks open connections of a server, so that they can be closed when the application shuts down
+type connSet struct {
+	lock  sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// add tracks a connection, returns false if the application is shutting down (the connection should be closed then)
+func (s *connSet) add(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if isShuttingDown() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *connSet) remove(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeAll closes all tracked connections
+func (s *connSet) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// shutdown gracefully stops the application within timeout:
+//	- stops gateways from accepting new log entries
+//	- stops taking log entries from buffer and waits for in-flight writes to complete
+//	- destroys log writers
+//	- closes buffer
+// Log entries taken from buffer whose writes do not complete before timeout are left in buffer and processed again on next start.
+func shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	close(shuttingDown)
+
+	// stop gateways
+	shutdownHooksLock.Lock()
+	hooks := shutdownHooks
+	shutdownHooksLock.Unlock()
+	var wg sync.WaitGroup
+	for _, hook := range hooks {
+		wg.Add(1)
+		go func(hook shutdownHook) {
+			defer wg.Done()
+			log.Printf("INFO: stopping %s...", hook.name)
+			hook.fn(ctx)
+		}(hook)
+	}
+	wg.Wait()
+
+	// wait for in-flight writes
+	log.Printf("INFO: waiting for in-flight writes to complete...")
+	writesDone := make(chan struct{})
+	go func() {
+		<-writeLogsDone
+		<-orphanLogsDone
+		writesWg.Wait()
+		close(writesDone)
+	}()
+	if !waitUntil(ctx, writesDone) {
+		log.Printf("WARN: timed out waiting for in-flight writes, unfinished log entries will be processed again on next start")
+	}
+
+	// destroy log writers, preventing configurations from being reloaded meanwhile
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	retiredDone := make(chan struct{})
+	go func() {
+		retiringWg.Wait()
+		close(retiredDone)
+	}()
+	if !waitUntil(ctx, retiredDone) {
+		log.Printf("WARN: timed out waiting for in-flight writes of retired log writers")
+	}
+	logWritersLock.RLock()
+	for cat, lwi := range LogWriters {
+		if err := lwi.LogWriter.Destroy(); err != nil {
+			log.Printf("ERROR: error destroying log writer for category [%s]: %e", cat, err)
+		}
+	}
+	logWritersLock.RUnlock()
+
+	// close buffer, log entries waiting for their next attempts are requeued as orphan messages on next start
+	stopDelayedRetries()
+	atomic.StoreInt32(&bufferClosed, 1)
+	if b, ok := Buffer.(interface{ Destroy() }); ok {
+		log.Printf("INFO: closing buffer...")
+		b.Destroy()
+	}
+	log.Printf("INFO: shutdown completed")
+}
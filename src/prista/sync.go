@@ -0,0 +1,78 @@
+package prista
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"main/src/logger"
+	"time"
+)
+
+var (
+	errSyncTimeout = errors.New("timed out waiting for log entry to be written, it may or may not have been written")
+	errBreakerOpen = errors.New("circuit breaker of log writer is open, log entry rejected")
+	errNoWriteSlot = errors.New("no write slot available, log entry rejected")
+
+	// gateways that can report result of writing log entries to clients, log entries received via other gateways are
+	// always put to buffer
+	syncGateways = map[string]bool{gatewayHttp: true, gatewayGrpc: true}
+)
+
+// isSyncDelivery returns true if a log entry is to be written before the gateway responds (delivery=sync)
+func isSyncDelivery(entry *logger.LogEntry, lwi *logger.LogWriterAndInfo) bool {
+	return lwi != nil && lwi.Delivery.IsSync() && syncGateways[entry.Gateway]
+}
+
+// writeSync writes a log entry with the log writer of its category, bypassing buffer, and waits at most the category's
+// sync_timeout for the result. The log entry is not retried: the error is returned so that the client can retry.
+//
+// The write takes a write slot shared with writes from buffer (see writeScheduler), the log entry is rejected with
+// errNoWriteSlot if none is free. If timed out, the write keeps running in background (holding its slot) and its result
+// is only recorded to metrics: the log entry may still be written, so a client retrying after a timeout may produce a
+// duplicate.
+func writeSync(entry *logger.LogEntry) error {
+	cat, lwi := acquireLogWriter(entry.Category)
+	if lwi == nil {
+		return errors.New(fmt.Sprintf("no log writer found for category [%s]", entry.Category))
+	}
+	if writeSched != nil && !writeSched.tryAcquire(cat, writerConcurrency(writeSched, cat)) {
+		lwi.InFlight.Done()
+		metricLogFailed.WithLabelValues(cat).Inc()
+		return errNoWriteSlot
+	}
+	release := func() {
+		if writeSched != nil {
+			writeSched.releaseSlot(cat)
+		}
+		lwi.InFlight.Done()
+	}
+	if allowed, _ := lwi.Breaker.Allow(); !allowed {
+		release()
+		metricLogFailed.WithLabelValues(cat).Inc()
+		return errBreakerOpen
+	}
+	result := make(chan error, 1)
+	writesWg.Add(1)
+	go func() {
+		defer writesWg.Done()
+		defer release()
+		err := writeLogEntry(cat, lwi, entry)
+		recordWrite(cat, err)
+		if err != nil {
+			log.Printf(fmt.Sprintf("ERROR: error writing log to [%s] (sync delivery): %e", entry.Category, err))
+			metricLogFailed.WithLabelValues(cat).Inc()
+		} else {
+			metricLogWritten.WithLabelValues(cat).Inc()
+		}
+		result <- err
+	}()
+	timer := time.NewTimer(lwi.Delivery.SyncTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		log.Printf(fmt.Sprintf("WARN: timed out writing log to [%s] (sync delivery) after %s", entry.Category, lwi.Delivery.SyncTimeout))
+		return errSyncTimeout
+	}
+}
@@ -0,0 +1,357 @@
+package prista
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"main/src/logger"
+	"main/src/utils"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyslogCategory = "syslog"
+
+	// max length of hostname and app-name substituted into category placeholders
+	maxSyslogPlaceholderLength = 64
+)
+
+// syslogRule maps syslog messages to a category. All configured criteria must match for the rule to match.
+type syslogRule struct {
+	facilities map[int]bool // match if facility of the message is one of these (empty: any)
+	appName    string       // glob pattern to match app-name/tag of the message (empty: any)
+	hostname   string       // glob pattern to match hostname of the message (empty: any)
+	category   string       // category of matched messages, can contain placeholders {facility}, {severity}, {app_name} and {hostname}
+}
+
+func (r *syslogRule) match(msg *syslogMessage) bool {
+	if len(r.facilities) > 0 && !r.facilities[msg.facility] {
+		return false
+	}
+	if r.appName != "" {
+		if ok, _ := path.Match(r.appName, strings.ToLower(msg.appName)); !ok {
+			return false
+		}
+	}
+	if r.hostname != "" {
+		if ok, _ := path.Match(r.hostname, strings.ToLower(msg.hostname)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// syslogReceiver converts received syslog messages to log entries
+type syslogReceiver struct {
+	rules           []*syslogRule
+	defaultCategory string
+	maxMessageSize  int
+	idleTimeout     time.Duration // TCP connection is closed if no data received within this duration
+	limiter         *connLimiter
+	conns           connSet
+}
+
+// parseSyslogRules parses syslog mapping rules from config, which is a list of objects {facility=..., app_name=..., hostname=..., category=...}
+func parseSyslogRules(conf interface{}) ([]*syslogRule, error) {
+	list, ok := conf.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("invalid syslog rules, expecting a list but received %T", conf))
+	}
+	rules := make([]*syslogRule, 0, len(list))
+	for i, item := range list {
+		if item == nil {
+			// empty list
+			continue
+		}
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid syslog rule #%d, expecting an object but received %T", i, item))
+		}
+		rule := &syslogRule{facilities: make(map[int]bool)}
+		for k, v := range m {
+			value := strings.TrimSpace(fmt.Sprintf("%v", v))
+			switch k {
+			case "facility":
+				for _, f := range strings.Split(value, ",") {
+					if facility, err := parseSyslogFacility(f); err != nil {
+						return nil, errors.New(fmt.Sprintf("invalid syslog rule #%d: %s", i, err.Error()))
+					} else {
+						rule.facilities[facility] = true
+					}
+				}
+			case "app_name":
+				rule.appName = strings.ToLower(value)
+			case "hostname":
+				rule.hostname = strings.ToLower(value)
+			case "category":
+				rule.category = value
+			default:
+				return nil, errors.New(fmt.Sprintf("invalid syslog rule #%d: unknown key [%s]", i, k))
+			}
+		}
+		for _, pattern := range []string{rule.appName, rule.hostname} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid syslog rule #%d: invalid pattern [%s]", i, pattern))
+			}
+		}
+		if rule.category == "" {
+			return nil, errors.New(fmt.Sprintf("invalid syslog rule #%d: no category defined", i))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// category returns category of a syslog message: the category of the first matched rule, or the default category if no rule matches
+func (sr *syslogReceiver) category(msg *syslogMessage) string {
+	category := sr.defaultCategory
+	for _, rule := range sr.rules {
+		if rule.match(msg) {
+			category = rule.category
+			break
+		}
+	}
+	category = strings.NewReplacer(
+		"{facility}", syslogFacilityName(msg.facility),
+		"{severity}", syslogSeverityName(msg.severity),
+		"{app_name}", sanitizeSyslogPlaceholder(msg.appName),
+		"{hostname}", sanitizeSyslogPlaceholder(msg.hostname),
+	).Replace(category)
+	if strings.TrimSpace(category) == "" {
+		category = sr.defaultCategory
+	}
+	return category
+}
+
+// sanitizeSyslogPlaceholder makes a value supplied by syslog senders safe to be part of a category name: characters
+// other than letters, digits, '.', '-' and '_' are replaced by '_', and the value is truncated to maxSyslogPlaceholderLength
+func sanitizeSyslogPlaceholder(v string) string {
+	var sb strings.Builder
+	for _, c := range v {
+		if sb.Len() >= maxSyslogPlaceholderLength {
+			break
+		}
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_' {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// toLogEntry converts a syslog message to a log entry. Severity, facility, hostname... are kept as extra fields of the entry.
+func (sr *syslogReceiver) toLogEntry(msg *syslogMessage, source string) *logger.LogEntry {
+	entry := newLogEntry(sr.category(msg), msg.message, gatewaySyslog, source)
+	if !msg.timestamp.IsZero() {
+		entry.Timestamp = msg.timestamp
+	}
+	entry.Fields = map[string]string{
+		"facility": syslogFacilityName(msg.facility),
+		"severity": syslogSeverityName(msg.severity),
+	}
+	for k, v := range map[string]string{"hostname": msg.hostname, "app_name": msg.appName, "proc_id": msg.procId,
+		"msg_id": msg.msgId, "structured_data": msg.structuredData} {
+		if v != "" {
+			entry.Fields[k] = v
+		}
+	}
+	return entry
+}
+
+// handle parses a received syslog message and puts it to buffer
+func (sr *syslogReceiver) handle(data []byte, source string) {
+	msg, err := parseSyslogMessage(data, time.Now())
+	if err != nil {
+		countGatewayRejected(gatewaySyslog)
+		log.Printf(fmt.Sprintf("WARN: invalid syslog message from [%s]: %s", source, err.Error()))
+		return
+	}
+	if err := handleIncomingMessage(sr.toLogEntry(msg, source), true); err != nil && err != errBufferFull {
+		log.Printf(err.Error())
+	}
+}
+
+// initialize and start syslog servers (UDP and/or TCP)
+func initSyslogServer(wg *sync.WaitGroup) bool {
+	udpPort := AppConfig.GetInt32("server.syslog.udp_port", 0)
+	tcpPort := AppConfig.GetInt32("server.syslog.tcp_port", 0)
+	if udpPort <= 0 && tcpPort <= 0 {
+		log.Println("No valid [server.syslog.udp_port] or [server.syslog.tcp_port] configured, syslog server is disabled.")
+		return false
+	}
+	if Auth != nil {
+		// syslog messages have no room for credentials, clients could write to any category without a key
+		panic("syslog server can not authenticate clients, disable it [server.syslog.udp_port/tcp_port] when API-key authentication is enabled [server.auth.enabled]")
+	}
+	listenAddr := AppConfig.GetString("server.syslog.listen_addr", "127.0.0.1")
+	receiver := &syslogReceiver{
+		defaultCategory: strings.TrimSpace(AppConfig.GetString("server.syslog.default_category", defaultSyslogCategory)),
+		maxMessageSize:  maxMessageSize(),
+		idleTimeout:     AppConfig.GetTimeDuration("server.syslog.idle_timeout", defaultTcpIdleTimeout),
+		limiter:         newConnLimiter("server.syslog"),
+	}
+	if receiver.defaultCategory == "" {
+		receiver.defaultCategory = defaultSyslogCategory
+	}
+	if rulesConf := AppConfig.GetValue("server.syslog.rules"); rulesConf != nil && !rulesConf.IsEmpty() {
+		rules, err := parseSyslogRules(utils.UnwrapHocon(rulesConf))
+		if err != nil {
+			panic(err)
+		}
+		receiver.rules = rules
+	}
+
+	appInfo := AppConfig.GetString("app.name") + " v" + AppConfig.GetString("app.version")
+	if udpPort > 0 {
+		pc, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", listenAddr, udpPort))
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Starting [%s] syslog UDP server on [%s:%d]...\n", appInfo, listenAddr, udpPort)
+		onShutdown("syslog UDP server", func(context.Context) {
+			pc.Close()
+		})
+		wg.Add(1)
+		go receiver.serveUdp(wg, pc)
+	}
+	if tcpPort > 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenAddr, tcpPort))
+		if err != nil {
+			panic(err)
+		}
+		tlsConfig, err := loadServerTlsConfig("server.syslog")
+		if err != nil {
+			panic(err)
+		}
+		protocol := "TCP"
+		if tlsConfig != nil {
+			// RFC 5425: syslog over TLS, framed with octet counting
+			listener = tls.NewListener(listener, tlsConfig)
+			protocol = "TCP+TLS"
+		}
+		log.Printf("Starting [%s] syslog %s server on [%s:%d]...\n", appInfo, protocol, listenAddr, tcpPort)
+		onShutdown("syslog TCP server", func(context.Context) {
+			listener.Close()
+			receiver.conns.closeAll()
+		})
+		wg.Add(1)
+		go serveConns(wg, listener, "syslog "+protocol, receiver.limiter, &receiver.conns, receiver.handleTcpConn)
+	}
+	return true
+}
+
+// serveUdp receives syslog messages via UDP, one message per datagram
+func (sr *syslogReceiver) serveUdp(wg *sync.WaitGroup, pc net.PacketConn) {
+	defer wg.Done()
+	defer pc.Close()
+	buffer := make([]byte, sr.maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buffer)
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			log.Printf(fmt.Sprintf("ERROR: error while reading syslog UDP data: %e", err))
+		} else if n > 0 {
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+			go sr.handle(data, addr.String())
+		}
+	}
+}
+
+var (
+	errSyslogFraming  = errors.New("invalid syslog message length")
+	errSyslogTooLarge = errors.New("syslog message exceeds max size")
+)
+
+// readSyslogFrame reads a syslog message from a stream. Both framing methods of RFC 6587 are supported:
+//	- octet counting: "<message-length> <message>"
+//	- non-transparent framing: messages are delimited by new line characters
+// Messages larger than maxSize are consumed and errSyslogTooLarge is returned, reading can continue with the next message.
+// errSyslogFraming is returned if message length is invalid, the stream cannot be read further then.
+func readSyslogFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		switch c := first[0]; {
+		case c >= '1' && c <= '9':
+			// octet counting
+			lenStr, err := r.ReadString(' ')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if err != nil || len(lenStr) > 11 {
+				return nil, errSyslogFraming
+			}
+			length, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+			if err != nil {
+				return nil, errSyslogFraming
+			}
+			if length > maxSize {
+				if _, err := io.CopyN(ioutil.Discard, r, int64(length)); err != nil {
+					return nil, err
+				}
+				return nil, errSyslogTooLarge
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			return data, nil
+		case c == '\n' || c == '\r' || c == 0:
+			// skip stray delimiters
+			r.ReadByte()
+		default:
+			// non-transparent framing
+			line, err := readLine(r, maxSize)
+			if err == errLineTooLong {
+				return nil, errSyslogTooLarge
+			}
+			return line, err
+		}
+	}
+}
+
+// handleTcpConn reads syslog messages from a TCP connection until it is closed or idle for longer than idleTimeout
+func (sr *syslogReceiver) handleTcpConn(conn net.Conn) {
+	source := conn.RemoteAddr().String()
+	r := bufio.NewReader(conn)
+	for {
+		if sr.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(sr.idleTimeout))
+		}
+		data, err := readSyslogFrame(r, sr.maxMessageSize)
+		switch {
+		case err == nil:
+			sr.handle(data, source)
+		case err == errSyslogTooLarge:
+			log.Printf(fmt.Sprintf("WARN: syslog message from [%s] exceeds max size %d, discarded", source, sr.maxMessageSize))
+			countGatewayRejected(gatewaySyslog)
+		case err == errSyslogFraming:
+			log.Printf(fmt.Sprintf("WARN: invalid syslog message length from [%s], closing connection", source))
+			return
+		case isIdleTimeout(err):
+			log.Printf(fmt.Sprintf("INFO: syslog TCP connection from [%s] is idle, closing", source))
+			return
+		default:
+			if err != io.EOF && err != io.ErrUnexpectedEOF && !isShuttingDown() {
+				log.Printf(fmt.Sprintf("ERROR: error while reading syslog TCP data from [%s]: %e", source, err))
+			}
+			return
+		}
+	}
+}
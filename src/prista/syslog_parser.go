@@ -0,0 +1,205 @@
+package prista
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"main/src/utils"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogMessage is a parsed syslog message (RFC 3164 or RFC 5424).
+type syslogMessage struct {
+	facility       int
+	severity       int
+	timestamp      time.Time // zero if not supplied
+	hostname       string
+	appName        string
+	procId         string
+	msgId          string
+	structuredData string // RFC 5424 only, raw structured data elements
+	message        string
+}
+
+var (
+	syslogFacilityNames = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+	syslogSeverityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+	// TAG of RFC 3164 message, e.g. "sshd[1234]: " or "kernel: "
+	reSyslogTag = regexp.MustCompile(`^([^\s\[\]:]{1,48})(?:\[([^\]\s]*)\])?:\s?`)
+
+	utf8Bom = []byte{0xEF, 0xBB, 0xBF}
+)
+
+const (
+	syslogNilValue        = "-"
+	syslogRfc3164TsLayout = "Jan _2 15:04:05"
+)
+
+func syslogFacilityName(facility int) string {
+	if facility >= 0 && facility < len(syslogFacilityNames) {
+		return syslogFacilityNames[facility]
+	}
+	return strconv.Itoa(facility)
+}
+
+func syslogSeverityName(severity int) string {
+	if severity >= 0 && severity < len(syslogSeverityNames) {
+		return syslogSeverityNames[severity]
+	}
+	return strconv.Itoa(severity)
+}
+
+// parseSyslogFacility parses a facility, either its name (e.g. "auth", "local0") or its numeric code
+func parseSyslogFacility(v string) (int, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	for i, name := range syslogFacilityNames {
+		if name == v {
+			return i, nil
+		}
+	}
+	if i, err := strconv.Atoi(v); err == nil && i >= 0 && i < len(syslogFacilityNames) {
+		return i, nil
+	}
+	return -1, errors.New(fmt.Sprintf("invalid syslog facility [%s]", v))
+}
+
+// parseSyslogMessage parses a syslog message, format RFC 5424 or RFC 3164.
+//
+// RFC 3164 messages are parsed leniently: missing timestamp, hostname or tag are accepted, and the RFC 3164 timestamp
+// (which has no year) is assumed to be in the configured timezone and within the last year.
+func parseSyslogMessage(data []byte, now time.Time) (*syslogMessage, error) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+	if len(data) < 3 || data[0] != '<' {
+		return nil, errors.New("invalid syslog message: missing PRI")
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("invalid syslog message: invalid PRI")
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, errors.New("invalid syslog message: invalid PRI")
+	}
+	msg := &syslogMessage{facility: pri / 8, severity: pri % 8}
+	data = data[end+1:]
+	if bytes.HasPrefix(data, []byte("1 ")) {
+		return msg, parseSyslogRfc5424(msg, string(data[2:]))
+	}
+	parseSyslogRfc3164(msg, string(data), now)
+	return msg, nil
+}
+
+// nextSyslogToken returns the next space-delimited token and the remaining string
+func nextSyslogToken(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func syslogValue(v string) string {
+	if v == syslogNilValue {
+		return ""
+	}
+	return v
+}
+
+// parseSyslogRfc5424 parses the part following "<PRI>1 " of a RFC 5424 message:
+// TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseSyslogRfc5424(msg *syslogMessage, s string) error {
+	var token string
+	token, s = nextSyslogToken(s)
+	if token != syslogNilValue {
+		if ts, err := time.Parse(time.RFC3339Nano, token); err != nil {
+			return errors.New("invalid syslog message: invalid timestamp [" + token + "]")
+		} else {
+			msg.timestamp = ts
+		}
+	}
+	token, s = nextSyslogToken(s)
+	msg.hostname = syslogValue(token)
+	token, s = nextSyslogToken(s)
+	msg.appName = syslogValue(token)
+	token, s = nextSyslogToken(s)
+	msg.procId = syslogValue(token)
+	token, s = nextSyslogToken(s)
+	msg.msgId = syslogValue(token)
+
+	// STRUCTURED-DATA: "-" or one or more elements "[id param="value"...]", where '"', '\' and ']' in values are escaped with '\'
+	if strings.HasPrefix(s, syslogNilValue) {
+		s = s[len(syslogNilValue):]
+	} else if strings.HasPrefix(s, "[") {
+		i, inQuote := 0, false
+	loop:
+		for ; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '\\' && inQuote:
+				i++
+			case c == '"':
+				inQuote = !inQuote
+			case c == ']' && !inQuote:
+				if i+1 >= len(s) || s[i+1] != '[' {
+					i++
+					break loop
+				}
+			}
+		}
+		if inQuote || i > len(s) || s[i-1] != ']' {
+			return errors.New("invalid syslog message: invalid structured data")
+		}
+		msg.structuredData, s = s[:i], s[i:]
+	} else if s != "" {
+		return errors.New("invalid syslog message: invalid structured data")
+	}
+	if s != "" && s[0] != ' ' {
+		return errors.New("invalid syslog message: invalid structured data")
+	}
+	msg.message = strings.TrimPrefix(strings.TrimPrefix(s, " "), string(utf8Bom))
+	return nil
+}
+
+// parseSyslogRfc3164 parses the part following "<PRI>" of a RFC 3164 message: TIMESTAMP SP HOSTNAME SP TAG MSG
+func parseSyslogRfc3164(msg *syslogMessage, s string, now time.Time) {
+	loc := utils.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	if len(s) >= len(syslogRfc3164TsLayout) {
+		if ts, err := time.ParseInLocation(syslogRfc3164TsLayout, s[:len(syslogRfc3164TsLayout)], loc); err == nil {
+			now = now.In(loc)
+			ts = time.Date(now.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, loc)
+			if ts.After(now.Add(24 * time.Hour)) {
+				// message sent in December, received in January
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			msg.timestamp = ts
+			s = strings.TrimLeft(s[len(syslogRfc3164TsLayout):], " ")
+		}
+	}
+	if msg.timestamp.IsZero() {
+		// some senders use RFC 3339 timestamp in RFC 3164 messages
+		token, rest := nextSyslogToken(s)
+		if ts, err := time.Parse(time.RFC3339Nano, token); err == nil {
+			msg.timestamp = ts
+			s = rest
+		}
+	}
+	if !msg.timestamp.IsZero() {
+		// HOSTNAME is present only if TIMESTAMP is
+		if token, rest := nextSyslogToken(s); rest != "" && !reSyslogTag.MatchString(s) {
+			msg.hostname = token
+			s = rest
+		}
+	}
+	if m := reSyslogTag.FindStringSubmatch(s); m != nil {
+		msg.appName, msg.procId = m[1], m[2]
+		s = s[len(m[0]):]
+	}
+	msg.message = s
+}
@@ -0,0 +1,171 @@
+package prista
+
+import (
+	"bufio"
+	"io"
+	"main/src/utils"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	utils.Location = time.UTC
+	defer func() { utils.Location = nil }()
+	now := time.Date(2020, 2, 8, 13, 14, 15, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		data     string
+		expected *syslogMessage
+	}{
+		// RFC 5424, section 6.5
+		{"rfc5424 example 1",
+			"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \xEF\xBB\xBF'su root' failed for lonvick on /dev/pts/8",
+			&syslogMessage{facility: 4, severity: 2, timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				hostname: "mymachine.example.com", appName: "su", msgId: "ID47", message: "'su root' failed for lonvick on /dev/pts/8"}},
+		{"rfc5424 example 2",
+			"<165>1 2003-08-24T05:14:15.000003-07:00 192.0.2.1 myproc 8710 - - %% It's time to make the do-nuts.",
+			&syslogMessage{facility: 20, severity: 5, timestamp: time.Date(2003, 8, 24, 5, 14, 15, 3000, time.FixedZone("", -7*3600)),
+				hostname: "192.0.2.1", appName: "myproc", procId: "8710", message: "%% It's time to make the do-nuts."}},
+		{"rfc5424 example 3",
+			`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"] ` + "\xEF\xBB\xBF" + `An application event log entry...`,
+			&syslogMessage{facility: 20, severity: 5, timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				hostname: "mymachine.example.com", appName: "evntslog", msgId: "ID47",
+				structuredData: `[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"]`, message: "An application event log entry..."}},
+		{"rfc5424 example 4",
+			`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"]`,
+			&syslogMessage{facility: 20, severity: 5, timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				hostname: "mymachine.example.com", appName: "evntslog", msgId: "ID47",
+				structuredData: `[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"]`}},
+		{"rfc5424 escaped structured data",
+			`<14>1 - host app - - [id k="a \"quoted\] value\\"] msg`,
+			&syslogMessage{facility: 1, severity: 6, hostname: "host", appName: "app", structuredData: `[id k="a \"quoted\] value\\"]`, message: "msg"}},
+		{"rfc5424 nil values", "<14>1 - - - - - -",
+			&syslogMessage{facility: 1, severity: 6}},
+		{"rfc5424 trailing new line", "<14>1 - host app - - - msg\r\n",
+			&syslogMessage{facility: 1, severity: 6, hostname: "host", appName: "app", message: "msg"}},
+		// RFC 3164, section 5.4
+		{"rfc3164 example 1",
+			"<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			&syslogMessage{facility: 4, severity: 2, timestamp: time.Date(2019, 10, 11, 22, 14, 15, 0, time.UTC),
+				hostname: "mymachine", appName: "su", message: "'su root' failed for lonvick on /dev/pts/8"}},
+		{"rfc3164 example 2",
+			"<13>Feb  5 17:32:18 10.0.0.99 Use the BFG!",
+			&syslogMessage{facility: 1, severity: 5, timestamp: time.Date(2020, 2, 5, 17, 32, 18, 0, time.UTC),
+				hostname: "10.0.0.99", message: "Use the BFG!"}},
+		{"rfc3164 with pid", "<86>Feb  8 13:00:00 web-1 sshd[1234]: Accepted publickey for root",
+			&syslogMessage{facility: 10, severity: 6, timestamp: time.Date(2020, 2, 8, 13, 0, 0, 0, time.UTC),
+				hostname: "web-1", appName: "sshd", procId: "1234", message: "Accepted publickey for root"}},
+		{"rfc3164 without hostname", "<13>Feb  8 13:00:00 kernel: oops",
+			&syslogMessage{facility: 1, severity: 5, timestamp: time.Date(2020, 2, 8, 13, 0, 0, 0, time.UTC),
+				appName: "kernel", message: "oops"}},
+		{"rfc3164 without timestamp", "<13>myapp: hello",
+			&syslogMessage{facility: 1, severity: 5, appName: "myapp", message: "hello"}},
+		{"rfc3164 with rfc3339 timestamp", "<13>2020-02-08T13:00:00Z host app: hello",
+			&syslogMessage{facility: 1, severity: 5, timestamp: time.Date(2020, 2, 8, 13, 0, 0, 0, time.UTC),
+				hostname: "host", appName: "app", message: "hello"}},
+		// year rollover: RFC 3164 timestamps have no year
+		{"rfc3164 same day", "<13>Feb  8 23:59:59 host app: hello",
+			&syslogMessage{facility: 1, severity: 5, timestamp: time.Date(2020, 2, 8, 23, 59, 59, 0, time.UTC),
+				hostname: "host", appName: "app", message: "hello"}},
+		{"rfc3164 sent last year", "<13>Dec 31 23:59:59 host app: hello",
+			&syslogMessage{facility: 1, severity: 5, timestamp: time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC),
+				hostname: "host", appName: "app", message: "hello"}},
+		// malformed messages
+		{"missing pri", "hello", nil},
+		{"invalid pri", "<abc>hello", nil},
+		{"pri out of range", "<192>hello", nil},
+		{"unterminated pri", "<13 hello", nil},
+		{"rfc5424 invalid timestamp", "<14>1 yesterday host app - - - msg", nil},
+		{"rfc5424 unterminated structured data", `<14>1 - host app - - [id k="v" msg`, nil},
+		{"rfc5424 unterminated quote", `<14>1 - host app - - [id k="v] msg`, nil},
+		{"rfc5424 structured data not separated from msg", `<14>1 - host app - - [id k="v"]msg`, nil},
+		{"rfc5424 invalid structured data", `<14>1 - host app - - id k="v" msg`, nil},
+	}
+	for _, tc := range testCases {
+		msg, err := parseSyslogMessage([]byte(tc.data), now)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected error but received %#v", tc.name, msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+			continue
+		}
+		if !msg.timestamp.Equal(tc.expected.timestamp) {
+			t.Errorf("%s: expected timestamp %s but received %s", tc.name, tc.expected.timestamp, msg.timestamp)
+		}
+		msg.timestamp = tc.expected.timestamp
+		if !reflect.DeepEqual(tc.expected, msg) {
+			t.Errorf("%s: expected %#v but received %#v", tc.name, tc.expected, msg)
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	type frame struct {
+		data string
+		err  error
+	}
+	testCases := []struct {
+		name     string
+		stream   string
+		maxSize  int
+		expected []frame
+	}{
+		{"octet counting", "12 <13>hello 1211 <13>world\n!", 100,
+			[]frame{{"<13>hello 12", nil}, {"<13>world\n!", nil}, {"", io.EOF}}},
+		{"new line delimited", "<13>hello\n<13>world\r\n\n<13>last", 100,
+			[]frame{{"<13>hello", nil}, {"<13>world\r", nil}, {"<13>last", nil}, {"", io.EOF}}},
+		{"mixed framing", "<13>hello\n9 <13>world", 100,
+			[]frame{{"<13>hello", nil}, {"<13>world", nil}, {"", io.EOF}}},
+		{"stray delimiters", "\n\r\x00\n8 <13>abcd", 100,
+			[]frame{{"<13>abcd", nil}, {"", io.EOF}}},
+		{"octet counting too large", "10 <13>abcdef8 <13>abcd", 8,
+			[]frame{{"", errSyslogTooLarge}, {"<13>abcd", nil}, {"", io.EOF}}},
+		{"new line delimited too large", "<13>abcdef\n<13>abcd\n", 8,
+			[]frame{{"", errSyslogTooLarge}, {"<13>abcd", nil}, {"", io.EOF}}},
+		{"invalid length", "12a <13>hello", 100,
+			[]frame{{"", errSyslogFraming}}},
+		{"length too long", "123456789012 <13>hello", 100,
+			[]frame{{"", errSyslogFraming}}},
+		{"truncated message", "20 <13>hello", 100,
+			[]frame{{"", io.ErrUnexpectedEOF}}},
+	}
+	for _, tc := range testCases {
+		r := bufio.NewReader(strings.NewReader(tc.stream))
+		for i, expected := range tc.expected {
+			data, err := readSyslogFrame(r, tc.maxSize)
+			if err != expected.err {
+				t.Errorf("%s: frame #%d: expected error %v but received %v", tc.name, i, expected.err, err)
+				break
+			}
+			if err == nil && string(data) != expected.data {
+				t.Errorf("%s: frame #%d: expected %q but received %q", tc.name, i, expected.data, data)
+			}
+		}
+	}
+}
+
+func TestSanitizeSyslogPlaceholder(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"web-1.example.com", "web-1.example.com"},
+		{"my_app", "my_app"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"app name\twith\nspaces", "app_name_with_spaces"},
+		{"ứng-dụng", "_ng-d_ng"},
+		{strings.Repeat("a", 100), strings.Repeat("a", maxSyslogPlaceholderLength)},
+	}
+	for _, tc := range testCases {
+		if v := sanitizeSyslogPlaceholder(tc.input); v != tc.expected {
+			t.Errorf("sanitizeSyslogPlaceholder(%q): expected %q but received %q", tc.input, tc.expected, v)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package prista
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/src/logger"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tcpFormatAuto   = "auto"
+	tcpFormatTsv    = "tsv"
+	tcpFormatNdjson = "ndjson"
+
+	defaultTcpIdleTimeout    = 60 * time.Second
+	defaultTcpMaxConnections = 1024
+)
+
+// tcpServer receives newline-delimited log entries via TCP connections
+type tcpServer struct {
+	format        string        // format of log entries: tsv, ndjson or auto (detected per connection from the first line)
+	idleTimeout   time.Duration // connection is closed if no data received within this duration
+	maxLineLength int
+	limiter       *connLimiter
+	conns         connSet
+}
+
+// connLimiter limits number of concurrent connections of a stream server, in total and per client address
+type connLimiter struct {
+	maxConnections    int // max number of concurrent connections (0: no limit)
+	maxConnectionsPer int // max number of concurrent connections per client address (0: no limit)
+
+	lock        sync.Mutex
+	numConns    int
+	numConnsPer map[string]int
+}
+
+// newConnLimiter loads connection limits from config keys <confPath>.max_connections and <confPath>.max_connections_per_client
+func newConnLimiter(confPath string) *connLimiter {
+	return &connLimiter{
+		maxConnections:    int(AppConfig.GetInt32(confPath+".max_connections", defaultTcpMaxConnections)),
+		maxConnectionsPer: int(AppConfig.GetInt32(confPath+".max_connections_per_client", 0)),
+		numConnsPer:       make(map[string]int),
+	}
+}
+
+// initialize and start TCP server
+func initTcpServer(wg *sync.WaitGroup) bool {
+	listenPort := AppConfig.GetInt32("server.tcp.listen_port", 0)
+	if listenPort <= 0 {
+		log.Println("No valid [server.tcp.listen_port] configured, TCP server is disabled.")
+		return false
+	}
+	listenAddr := AppConfig.GetString("server.tcp.listen_addr", "127.0.0.1")
+	server := &tcpServer{
+		format:        strings.ToLower(strings.TrimSpace(AppConfig.GetString("server.tcp.format", tcpFormatAuto))),
+		idleTimeout:   AppConfig.GetTimeDuration("server.tcp.idle_timeout", defaultTcpIdleTimeout),
+		maxLineLength: maxMessageSize(),
+		limiter:       newConnLimiter("server.tcp"),
+	}
+	if server.format != tcpFormatAuto && server.format != tcpFormatTsv && server.format != tcpFormatNdjson {
+		panic(fmt.Sprintf("invalid [server.tcp.format]: %s", server.format))
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenAddr, listenPort))
+	if err != nil {
+		panic(err)
+	}
+	tlsConfig, err := loadServerTlsConfig("server.tcp")
+	if err != nil {
+		panic(err)
+	}
+	protocol := "TCP"
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		protocol = "TCP+TLS"
+	}
+	log.Printf("Starting [%s] %s server on [%s:%d]...\n", AppConfig.GetString("app.name")+" v"+AppConfig.GetString("app.version"), protocol, listenAddr, listenPort)
+	onShutdown("TCP server", func(context.Context) {
+		listener.Close()
+		server.conns.closeAll()
+	})
+	go serveConns(wg, listener, "TCP", server.limiter, &server.conns, server.handleConn)
+	return true
+}
+
+// serveConns accepts connections of a stream server until listener is closed, each accepted connection is served by
+// handle in its own go routine and closed when handle returns. Connections exceeding limits are closed immediately.
+func serveConns(wg *sync.WaitGroup, listener net.Listener, name string, limiter *connLimiter, conns *connSet, handle func(conn net.Conn)) {
+	defer wg.Done()
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			log.Printf(fmt.Sprintf("ERROR: error while accepting %s connection: %e", name, err))
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		client, ok := limiter.acquire(conn)
+		if !ok {
+			log.Printf("WARN: too many %s connections, connection from [%s] rejected", name, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer limiter.release(client)
+			defer conn.Close()
+			if !conns.add(conn) {
+				return
+			}
+			defer conns.remove(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// acquire checks connection limits and counts the connection if accepted
+func (l *connLimiter) acquire(conn net.Conn) (string, bool) {
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxConnections > 0 && l.numConns >= l.maxConnections {
+		return client, false
+	}
+	if l.maxConnectionsPer > 0 && l.numConnsPer[client] >= l.maxConnectionsPer {
+		return client, false
+	}
+	l.numConns++
+	l.numConnsPer[client]++
+	return client, true
+}
+
+func (l *connLimiter) release(client string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.numConns--
+	if l.numConnsPer[client]--; l.numConnsPer[client] <= 0 {
+		delete(l.numConnsPer, client)
+	}
+}
+
+// isIdleTimeout returns true if a read error is caused by idle timeout (read deadline exceeded)
+func isIdleTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// handleConn reads log entries from a connection, one entry per line
+func (s *tcpServer) handleConn(conn net.Conn) {
+	source := conn.RemoteAddr().String()
+	format := s.format
+	r := bufio.NewReader(conn)
+	for {
+		if s.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		line, err := readLine(r, s.maxLineLength)
+		if err == errLineTooLong {
+			countGatewayRejected(gatewayTcp)
+			log.Printf(fmt.Sprintf("WARN: line from [%s] exceeds max length %d, discarded", source, s.maxLineLength))
+			continue
+		}
+		if err != nil {
+			if isIdleTimeout(err) {
+				log.Printf(fmt.Sprintf("INFO: TCP connection from [%s] is idle, closing", source))
+			} else if err != io.EOF && !isShuttingDown() {
+				log.Printf(fmt.Sprintf("ERROR: error while reading TCP data from [%s]: %e", source, err))
+			}
+			return
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var key *apiKey
+		if Auth != nil {
+			// credentials prefix each line (see apiKeyAuth.authenticateMessage)
+			var payload string
+			if key, payload, err = Auth.authenticateMessage(string(line)); err != nil {
+				countAuth("", authUnauthenticated)
+				countGatewayRejected(gatewayTcp)
+				log.Printf(fmt.Sprintf("WARN: line from [%s] rejected: %s", source, err.Error()))
+				continue
+			}
+			line = []byte(payload)
+		}
+		if format == tcpFormatAuto {
+			// format is detected from the first line of the connection
+			if bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) {
+				format = tcpFormatNdjson
+			} else {
+				format = tcpFormatTsv
+			}
+		}
+		if err := s.handleLine(line, format, source, key); err != nil && err != errBufferFull {
+			log.Printf(fmt.Sprintf("WARN: invalid log entry from [%s]: %s", source, err.Error()))
+		}
+	}
+}
+
+// handleLine parses a log entry from a line and buffers it, key is the API key the line was authenticated with (nil if
+// authentication is disabled)
+func (s *tcpServer) handleLine(line []byte, format, source string, key *apiKey) error {
+	entry, err := parseTcpLine(line, format, source)
+	if err != nil {
+		countGatewayRejected(gatewayTcp)
+		return err
+	}
+	if err := authorize(key, entry); err != nil {
+		return err
+	}
+	return handleIncomingMessage(entry, true)
+}
+
+// parseTcpLine parses a log entry from a line, either in TSV or NDJSON format
+func parseTcpLine(line []byte, format, source string) (*logger.LogEntry, error) {
+	if format == tcpFormatNdjson {
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(line, &data); err != nil {
+			return nil, err
+		}
+		return parseJsonLogEntry(data, gatewayTcp, source)
+	}
+	timestamp, category, message, ok := parseTsvMessage(string(line))
+	if !ok {
+		return nil, errors.New("expected format [<timestamp><tab-character>]<category-name><tab-character><log-message>")
+	}
+	entry := newLogEntry(category, message, gatewayTcp, source)
+	if !timestamp.IsZero() {
+		entry.Timestamp = timestamp
+	}
+	return entry, nil
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line terminated by '\n' (the terminating '\n' is not returned).
+// If the line is longer than maxLength, the whole line is consumed and errLineTooLong is returned.
+func readLine(r *bufio.Reader, maxLength int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		frag, err := r.ReadSlice('\n')
+		if err == nil {
+			frag = frag[:len(frag)-1]
+		}
+		if !tooLong {
+			if len(line)+len(frag) > maxLength {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, frag...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong {
+			return nil, errLineTooLong
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		return line, nil
+	}
+}
@@ -0,0 +1,56 @@
+package prista
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	type line struct {
+		data string
+		err  error
+	}
+	testCases := []struct {
+		name       string
+		stream     string
+		bufferSize int
+		maxLength  int
+		expected   []line
+	}{
+		{"lines", "line 1\nline 2\n", 16, 100,
+			[]line{{"line 1", nil}, {"line 2", nil}, {"", io.EOF}}},
+		{"last line without new line", "line 1\nline 2", 16, 100,
+			[]line{{"line 1", nil}, {"line 2", nil}, {"", io.EOF}}},
+		{"empty lines", "\n\nline\n", 16, 100,
+			[]line{{"", nil}, {"", nil}, {"line", nil}, {"", io.EOF}}},
+		{"carriage return is kept", "line\r\n", 16, 100,
+			[]line{{"line\r", nil}, {"", io.EOF}}},
+		{"line longer than read buffer", strings.Repeat("a", 40) + "\nb\n", 16, 100,
+			[]line{{strings.Repeat("a", 40), nil}, {"b", nil}, {"", io.EOF}}},
+		{"line of max length", "12345678\n", 16, 8,
+			[]line{{"12345678", nil}, {"", io.EOF}}},
+		{"line too long", "123456789\nshort\n", 16, 8,
+			[]line{{"", errLineTooLong}, {"short", nil}, {"", io.EOF}}},
+		{"line too long and longer than read buffer", strings.Repeat("a", 40) + "\nshort\n", 16, 20,
+			[]line{{"", errLineTooLong}, {"short", nil}, {"", io.EOF}}},
+		{"last line too long", "short\n123456789", 16, 8,
+			[]line{{"short", nil}, {"", errLineTooLong}, {"", io.EOF}}},
+		{"empty stream", "", 16, 8,
+			[]line{{"", io.EOF}}},
+	}
+	for _, tc := range testCases {
+		r := bufio.NewReaderSize(strings.NewReader(tc.stream), tc.bufferSize)
+		for i, expected := range tc.expected {
+			data, err := readLine(r, tc.maxLength)
+			if err != expected.err {
+				t.Errorf("%s: line #%d: expected error %v but received %v", tc.name, i, expected.err, err)
+				break
+			}
+			if err == nil && string(data) != expected.data {
+				t.Errorf("%s: line #%d: expected %q but received %q", tc.name, i, expected.data, data)
+			}
+		}
+	}
+}
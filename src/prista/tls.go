@@ -0,0 +1,160 @@
+package prista
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTlsMinVersion = "1.2"
+	tlsReloadInterval    = time.Second // certificate files are checked for changes at most once per this interval
+
+	tlsClientAuthRequire       = "require"         // clients must present a certificate signed by the client CA
+	tlsClientAuthVerifyIfGiven = "verify_if_given" // clients may present a certificate, which is verified if presented
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTls keeps TLS settings of a server, reloading certificate, private key and client CA files when they change on disk
+type serverTls struct {
+	confPath     string
+	certFile     string
+	keyFile      string
+	clientCaFile string // empty if client certificates are not verified
+	clientAuth   tls.ClientAuthType
+	minVersion   uint16
+	nextProtos   []string
+
+	lock      sync.Mutex
+	config    *tls.Config          // TLS settings built from the files last loaded
+	modTimes  map[string]time.Time // modification time of the files last loaded
+	checkedAt time.Time            // last time the files were checked for changes
+}
+
+// loadServerTlsConfig loads TLS settings of a server from config block <confPath>.tls:
+//	- cert_file, key_file: certificate and private key (PEM format), TLS is enabled if both are configured
+//	- client_ca_file: CA certificates (PEM format) to verify client certificates (mutual TLS), optional
+//	- client_auth: "require" (default) or "verify_if_given", used only if client_ca_file is configured
+//	- min_version: minimum TLS version, "1.0", "1.1", "1.2" (default) or "1.3"
+// Certificate, private key and client CA files are reloaded when they change on disk, without restarting the server.
+// nextProtos are the application protocols supported by the server (ALPN). Returns nil if TLS is not configured for the server.
+func loadServerTlsConfig(confPath string, nextProtos ...string) (*tls.Config, error) {
+	certFile := strings.TrimSpace(AppConfig.GetString(confPath+".tls.cert_file", ""))
+	keyFile := strings.TrimSpace(AppConfig.GetString(confPath+".tls.key_file", ""))
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New(fmt.Sprintf("both [%s.tls.cert_file] and [%s.tls.key_file] must be configured to enable TLS", confPath, confPath))
+	}
+	st := &serverTls{
+		confPath:     confPath,
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCaFile: strings.TrimSpace(AppConfig.GetString(confPath+".tls.client_ca_file", "")),
+		nextProtos:   nextProtos,
+	}
+	minVersion := strings.TrimSpace(AppConfig.GetString(confPath+".tls.min_version", defaultTlsMinVersion))
+	if minVersion == "" {
+		minVersion = defaultTlsMinVersion
+	}
+	var ok bool
+	if st.minVersion, ok = tlsVersions[minVersion]; !ok {
+		return nil, errors.New(fmt.Sprintf("invalid [%s.tls.min_version]: %s", confPath, minVersion))
+	}
+	if st.clientCaFile != "" {
+		switch clientAuth := strings.ToLower(strings.TrimSpace(AppConfig.GetString(confPath+".tls.client_auth", tlsClientAuthRequire))); clientAuth {
+		case tlsClientAuthRequire, "":
+			st.clientAuth = tls.RequireAndVerifyClientCert
+		case tlsClientAuthVerifyIfGiven:
+			st.clientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid [%s.tls.client_auth]: %s", confPath, clientAuth))
+		}
+	}
+	if err := st.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         st.minVersion,
+		NextProtos:         nextProtos,
+		GetConfigForClient: st.getConfigForClient,
+	}, nil
+}
+
+func (st *serverTls) files() []string {
+	if st.clientCaFile != "" {
+		return []string{st.certFile, st.keyFile, st.clientCaFile}
+	}
+	return []string{st.certFile, st.keyFile}
+}
+
+// load (re)loads certificate, private key and client CA files, the current settings are kept if any of them fails to load
+func (st *serverTls) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range st.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = fi.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(st.certFile, st.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: st.minVersion, NextProtos: st.nextProtos}
+	if st.clientCaFile != "" {
+		pem, err := ioutil.ReadFile(st.clientCaFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New(fmt.Sprintf("no valid CA certificate found in [%s]", st.clientCaFile))
+		}
+		config.ClientCAs, config.ClientAuth = pool, st.clientAuth
+	}
+	st.config, st.modTimes = config, modTimes
+	return nil
+}
+
+// changed returns true if any of certificate, private key and client CA files has changed since they were last loaded
+func (st *serverTls) changed() bool {
+	for _, file := range st.files() {
+		if fi, err := os.Stat(file); err == nil && !fi.ModTime().Equal(st.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfigForClient implements tls.Config.GetConfigForClient, returning the current TLS settings
+func (st *serverTls) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if now := time.Now(); now.Sub(st.checkedAt) >= tlsReloadInterval {
+		st.checkedAt = now
+		if st.changed() {
+			if err := st.load(); err != nil {
+				log.Printf(fmt.Sprintf("ERROR: error reloading TLS certificates of [%s], keep using the current ones: %e", st.confPath, err))
+			} else {
+				log.Printf("INFO: TLS certificates of [%s] reloaded", st.confPath)
+			}
+		}
+	}
+	return st.config, nil
+}
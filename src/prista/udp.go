@@ -1,9 +1,10 @@
 package prista
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"math/big"
+	"main/src/logger"
 	"net"
 	"sync"
 )
@@ -22,28 +23,56 @@ func initUdpServer(wg *sync.WaitGroup, numServers int) bool {
 		panic(err)
 	}
 	log.Printf("Starting [%s] UDP server on [%s:%d]...\n", AppConfig.GetString("app.name")+" v"+AppConfig.GetString("app.version"), listenAddr, listenPort)
-	bodyLimit := AppConfig.GetByteSize("server.max_request_size")
-	if bodyLimit == nil || bodyLimit.Int64() <= 0 {
-		bodyLimit = big.NewInt(4086)
-	}
-	buffer := make([]byte, bodyLimit.Int64())
+	onShutdown("UDP server", func(context.Context) {
+		pc.Close()
+	})
 	for i := 0; i < numServers; i++ {
 		go func() {
+			defer wg.Done()
 			defer pc.Close()
+			// each server has its own read buffer
+			buffer := make([]byte, maxMessageSize())
 			for {
 				// ReadFrom blocks until data received or timed-out
-				n, _, err := pc.ReadFrom(buffer)
+				n, addr, err := pc.ReadFrom(buffer)
 				if err != nil {
+					if isShuttingDown() {
+						return
+					}
 					log.Printf(fmt.Sprintf("ERROR: error while reading UDP data: %e", err))
 				} else if n > 0 {
-					go func(payload []byte) {
-						if err := handleIncomingMessage(payload, true); err != nil {
+					datagram := string(buffer[:n])
+					var key *apiKey
+					if Auth != nil {
+						if key, datagram, err = Auth.authenticateMessage(datagram); err != nil {
+							countAuth("", authUnauthenticated)
+							countGatewayRejected(gatewayUdp)
+							log.Printf(fmt.Sprintf("WARN: UDP message from [%s] rejected: %s", addr, err.Error()))
+							continue
+						}
+					}
+					timestamp, category, message, ok := parseTsvMessage(datagram)
+					if !ok {
+						countGatewayRejected(gatewayUdp)
+						log.Printf(fmt.Sprintf("WARN: invalid UDP message from [%s], expected format [<timestamp><tab-character>]<category-name><tab-character><log-message>", addr))
+						continue
+					}
+					entry := newLogEntry(category, message, gatewayUdp, addr.String())
+					if !timestamp.IsZero() {
+						entry.Timestamp = timestamp
+					}
+					if err := authorize(key, entry); err != nil {
+						log.Printf(fmt.Sprintf("WARN: UDP message from [%s] rejected: %s", addr, err.Error()))
+						continue
+					}
+					go func(entry *logger.LogEntry) {
+						// entries rejected because buffer is full are counted by metric prista_buffer_rejected_total, not logged one by one
+						if err := handleIncomingMessage(entry, true); err != nil && err != errBufferFull {
 							log.Printf(err.Error())
 						}
-					}(buffer[:n])
+					}(entry)
 				}
 			}
-			wg.Done()
 		}()
 	}
 	return true
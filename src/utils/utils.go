@@ -8,10 +8,14 @@ package utils
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	olaf2 "github.com/btnguyen2k/consu/olaf"
 	"github.com/go-akka/configuration/hocon"
+	"math"
 	"math/rand"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -142,3 +146,74 @@ func unwrapHoconValue(h hocon.HoconValue) interface{} {
 func unwrapHoconObject(h hocon.HoconObject) interface{} {
 	return UnwrapHocon(h.Unwrapped())
 }
+
+var (
+	reByteSize = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?)\s*([A-Za-z]*)$`)
+	byteUnits  = map[string]float64{
+		"": 1, "B": 1, "b": 1, "byte": 1, "bytes": 1,
+		"kB": 1e3, "kilobyte": 1e3, "kilobytes": 1e3,
+		"MB": 1e6, "megabyte": 1e6, "megabytes": 1e6,
+		"GB": 1e9, "gigabyte": 1e9, "gigabytes": 1e9,
+		"TB": 1e12, "terabyte": 1e12, "terabytes": 1e12,
+		"K": 1 << 10, "k": 1 << 10, "Ki": 1 << 10, "KiB": 1 << 10, "kibibyte": 1 << 10, "kibibytes": 1 << 10,
+		"M": 1 << 20, "m": 1 << 20, "Mi": 1 << 20, "MiB": 1 << 20, "mebibyte": 1 << 20, "mebibytes": 1 << 20,
+		"G": 1 << 30, "g": 1 << 30, "Gi": 1 << 30, "GiB": 1 << 30, "gibibyte": 1 << 30, "gibibytes": 1 << 30,
+		"T": 1 << 40, "t": 1 << 40, "Ti": 1 << 40, "TiB": 1 << 40, "tebibyte": 1 << 40, "tebibytes": 1 << 40,
+	}
+)
+
+// ParseByteSize parses a size-in-bytes string in HOCON format (e.g. "4096", "10MB", "512 KiB") and returns the number of bytes.
+// See https://github.com/lightbend/config/blob/master/HOCON.md#size-in-bytes-format
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	groups := reByteSize.FindStringSubmatch(s)
+	if groups == nil {
+		return 0, errors.New(fmt.Sprintf("invalid byte size [%s]", s))
+	}
+	unit, ok := byteUnits[groups[3]]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("unknown byte size unit [%s]", groups[3]))
+	}
+	v, err := strconv.ParseFloat(groups[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(v * unit)), nil
+}
+
+var (
+	reDuration    = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?)\s*([A-Za-z]*)$`)
+	durationUnits = map[string]time.Duration{
+		"":   time.Millisecond,
+		"ns": time.Nanosecond, "nano": time.Nanosecond, "nanos": time.Nanosecond, "nanosecond": time.Nanosecond, "nanoseconds": time.Nanosecond,
+		"us": time.Microsecond, "micro": time.Microsecond, "micros": time.Microsecond, "microsecond": time.Microsecond, "microseconds": time.Microsecond,
+		"ms": time.Millisecond, "milli": time.Millisecond, "millis": time.Millisecond, "millisecond": time.Millisecond, "milliseconds": time.Millisecond,
+		"s": time.Second, "second": time.Second, "seconds": time.Second,
+		"m": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+		"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+		"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	}
+)
+
+// ParseDuration parses a duration string in HOCON format (e.g. "500", "10s", "7 days") and returns the duration.
+// Go-style duration strings (e.g. "1h30m") are also accepted.
+// See https://github.com/lightbend/config/blob/master/HOCON.md#duration-format
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	groups := reDuration.FindStringSubmatch(s)
+	if groups == nil {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d, nil
+		}
+		return 0, errors.New(fmt.Sprintf("invalid duration [%s]", s))
+	}
+	unit, ok := durationUnits[groups[3]]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("unknown duration unit [%s]", groups[3]))
+	}
+	v, err := strconv.ParseFloat(groups[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(v * float64(unit)), nil
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected int64
+		err      bool
+	}{
+		{"0", 0, false},
+		{"4096", 4096, false},
+		{" 4096 ", 4096, false},
+		{"10B", 10, false},
+		{"10 bytes", 10, false},
+		{"1kB", 1000, false},
+		{"1K", 1024, false},
+		{"512 KiB", 512 * 1024, false},
+		{"10MB", 10 * 1000 * 1000, false},
+		{"10M", 10 * 1024 * 1024, false},
+		{"1.5GiB", 3 * 512 * 1024 * 1024, false},
+		{"2 gigabytes", 2 * 1000 * 1000 * 1000, false},
+		{"1TiB", 1 << 40, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1MB", 0, true},
+		{"10XB", 0, true},
+		{"1,5MB", 0, true},
+	}
+	for _, tc := range testCases {
+		v, err := ParseByteSize(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q): expected error but received %d", tc.input, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseByteSize(%q): unexpected error %s", tc.input, err)
+		} else if v != tc.expected {
+			t.Errorf("ParseByteSize(%q): expected %d but received %d", tc.input, tc.expected, v)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected time.Duration
+		err      bool
+	}{
+		{"0", 0, false},
+		{"500", 500 * time.Millisecond, false},
+		{"500ms", 500 * time.Millisecond, false},
+		{"10s", 10 * time.Second, false},
+		{"10 seconds", 10 * time.Second, false},
+		{"1.5s", 1500 * time.Millisecond, false},
+		{"5m", 5 * time.Minute, false},
+		{"2h", 2 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"7 days", 7 * 24 * time.Hour, false},
+		{"100us", 100 * time.Microsecond, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"-1s", -time.Second, false},
+		{"", 0, true},
+		{"s", 0, true},
+		{"10y", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tc := range testCases {
+		v, err := ParseDuration(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParseDuration(%q): expected error but received %s", tc.input, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDuration(%q): unexpected error %s", tc.input, err)
+		} else if v != tc.expected {
+			t.Errorf("ParseDuration(%q): expected %s but received %s", tc.input, tc.expected, v)
+		}
+	}
+}